@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// accessLog records connections and errors when -accesslog is given
+var accessLog *log.Logger
+
+// openAccessLog appends access records to the named file
+func openAccessLog(path string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	accessLog = log.New(f, "", 0)
+	return nil
+}
+
+// logAccess writes one line: timestamp, remote address, server and event
+func logAccess(addr net.Addr, server, format string, a ...interface{}) {
+	if accessLog == nil {
+		return
+	}
+	accessLog.Printf("%s %s %s %s", time.Now().Format(time.RFC3339), remoteName(addr), server, fmt.Sprintf(format, a...))
+}
+
+// remoteName returns a client's address, or "-" when it has none
+func remoteName(addr net.Addr) string {
+	if addr == nil || addr.String() == "" {
+		return "-"
+	}
+	return addr.String()
+}
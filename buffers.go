@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
 	rl "github.com/gen2brain/raylib-go/raylib"
 	"strconv"
 	"sync"
+	"time"
 )
 
 // TextureEntry holds a texture created from pixel data
@@ -20,12 +22,75 @@ type BufferSystem struct {
 	flipBuffers  []*rl.RenderTexture2D
 	layerBuffers []*rl.RenderTexture2D
 	activeTarget int
+	preview      *rl.RenderTexture2D // Scratch layer for preview mode
+	previewFrame uint64              // Frame the preview was last cleared in
+	flipBg       []int               // Clear colour per flip buffer, -1 for paper
+	layerBg      []int               // Clear colour per layer buffer, -1 for transparent
+	chain        int                 // Flip buffers in the swap chain, 0 when off
+	stageFlip    *rl.RenderTexture2D // Hidden flip buffer drawn to while staging, else nil
+	stageLayer   *rl.RenderTexture2D // Hidden layer buffer drawn to while staging
 	mu          sync.RWMutex
 }
 
 // Global texture array (256 slots)
 var textures [256]TextureEntry
 
+// Texture memory accounting (bytes); a limit of 0 means unlimited
+var (
+	textureBytes    int
+	maxTextureBytes int
+)
+
+// pixelTransparent marks a pixel-data character that maps to transparency
+const pixelTransparent = -1
+
+// defaultPixelChars are the special pixel-data characters; anything else
+// must be a hex digit unless remapped with texmap
+var defaultPixelChars = map[rune]int{
+	'.': pixelTransparent, // Transparent pixel
+	'@': 7,                // Light grey
+	'%': 14,               // Bright white
+	'`': 0,                // Black
+}
+
+// Pixel-data character mapping, changed by texmap
+var (
+	pixelChars   = copyPixelChars(defaultPixelChars)
+	pixelCharsMu sync.RWMutex
+)
+
+func copyPixelChars(m map[rune]int) map[rune]int {
+	c := make(map[rune]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// lookupPixelChar returns the palette index (or pixelTransparent) a
+// pixel-data character is mapped to
+func lookupPixelChar(ch rune) (int, bool) {
+	pixelCharsMu.RLock()
+	defer pixelCharsMu.RUnlock()
+	idx, ok := pixelChars[ch]
+	return idx, ok
+}
+
+// setPixelChar maps a pixel-data character to a palette index or to
+// pixelTransparent
+func setPixelChar(ch rune, idx int) {
+	pixelCharsMu.Lock()
+	defer pixelCharsMu.Unlock()
+	pixelChars[ch] = idx
+}
+
+// resetPixelChars restores the default pixel-data characters
+func resetPixelChars() {
+	pixelCharsMu.Lock()
+	defer pixelCharsMu.Unlock()
+	pixelChars = copyPixelChars(defaultPixelChars)
+}
+
 // CaptureRegion represents a rectangular region to capture
 type CaptureRegion struct {
 	X      int
@@ -34,27 +99,45 @@ type CaptureRegion struct {
 	Height int
 }
 
-// NewBufferSystem creates a new buffer system with the specified number of buffers
-func NewBufferSystem(numBuffers int, width, height int32) *BufferSystem {
+// NewBufferSystem creates a new buffer system with the specified number of
+// buffers. If the GPU cannot provide every render texture, those already
+// made are released and an error is returned.
+func NewBufferSystem(numBuffers int, width, height int32) (*BufferSystem, error) {
 	bs := &BufferSystem{
 		flipBuffers:  make([]*rl.RenderTexture2D, numBuffers),
 		layerBuffers: make([]*rl.RenderTexture2D, numBuffers),
 		activeTarget: 0,
+		flipBg:       make([]int, numBuffers),
+		layerBg:      make([]int, numBuffers),
 	}
 
 	// Initialize all buffers
 	for i := 0; i < numBuffers; i++ {
+		bs.flipBg[i], bs.layerBg[i] = -1, -1
+
 		// Create flip buffer
 		rt := rl.LoadRenderTexture(width, height)
+		if !renderTextureValid(rt) {
+			bs.releaseRenderTextures()
+			return nil, fmt.Errorf("cannot create %dx%d flip buffer %d", width, height, i)
+		}
 		bs.flipBuffers[i] = &rt
 		
-		// Initialize with paper color
+		// Initialize with paper color, or transparent with -noclear
 		rl.BeginTextureMode(rt)
-		rl.ClearBackground(palette[effectivePaperColor()])
+		if noClear {
+			rl.ClearBackground(rl.Color{R: 0, G: 0, B: 0, A: 0})
+		} else {
+			rl.ClearBackground(palette[effectivePaperColor()])
+		}
 		rl.EndTextureMode()
 
 		// Create layer buffer
 		rt = rl.LoadRenderTexture(width, height)
+		if !renderTextureValid(rt) {
+			bs.releaseRenderTextures()
+			return nil, fmt.Errorf("cannot create %dx%d layer buffer %d", width, height, i)
+		}
 		bs.layerBuffers[i] = &rt
 		
 		// Initialize transparent
@@ -63,7 +146,22 @@ func NewBufferSystem(numBuffers int, width, height int32) *BufferSystem {
 		rl.EndTextureMode()
 	}
 
-	return bs
+	// Create the preview layer
+	rt := rl.LoadRenderTexture(width, height)
+	if !renderTextureValid(rt) {
+		bs.releaseRenderTextures()
+		return nil, fmt.Errorf("cannot create %dx%d preview layer", width, height)
+	}
+	bs.preview = &rt
+	bs.ClearPreview()
+
+	return bs, nil
+}
+
+// renderTextureValid reports whether raylib managed to create a render
+// texture; it returns zero ids when the GPU refuses
+func renderTextureValid(rt rl.RenderTexture2D) bool {
+	return rt.ID != 0 && rt.Texture.ID != 0
 }
 
 // GetDisplayBuffers returns buffer 0 of each type (always visible)
@@ -73,13 +171,85 @@ func (bs *BufferSystem) GetDisplayBuffers() (*rl.RenderTexture2D, *rl.RenderText
 	return bs.flipBuffers[0], bs.layerBuffers[0]
 }
 
-// GetTargetBuffers returns the current flip and layer buffers for drawing
+// GetTargetBuffers returns the current flip and layer buffers for drawing,
+// which are the hidden pair while staging
 func (bs *BufferSystem) GetTargetBuffers() (*rl.RenderTexture2D, *rl.RenderTexture2D) {
 	bs.mu.RLock()
 	defer bs.mu.RUnlock()
+	if bs.stageFlip != nil {
+		return bs.stageFlip, bs.stageLayer
+	}
 	return bs.flipBuffers[bs.activeTarget], bs.layerBuffers[bs.activeTarget]
 }
 
+// Stage starts sending all drawing to a hidden flip and layer pair that
+// begins as a copy of the visible buffers
+func (bs *BufferSystem) Stage() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.stageFlip != nil {
+		return fmt.Errorf("already staging")
+	}
+	rl.DrawRenderBatchActive()
+	w, h := bs.flipBuffers[0].Texture.Width, bs.flipBuffers[0].Texture.Height
+	flip, layer := rl.LoadRenderTexture(w, h), rl.LoadRenderTexture(w, h)
+	if !renderTextureValid(flip) || !renderTextureValid(layer) {
+		rl.UnloadRenderTexture(flip)
+		rl.UnloadRenderTexture(layer)
+		return fmt.Errorf("cannot create the staging buffers")
+	}
+	rl.UpdateTexture(flip.Texture, ReadBufferColors(bs.flipBuffers[0]))
+	rl.UpdateTexture(layer.Texture, ReadBufferColors(bs.layerBuffers[0]))
+	bs.stageFlip, bs.stageLayer = &flip, &layer
+	return nil
+}
+
+// Staging reports whether drawing is going to the hidden pair
+func (bs *BufferSystem) Staging() bool {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return bs.stageFlip != nil
+}
+
+// Commit copies the hidden pair onto flip and layer buffer 0 in one step
+// and sends drawing back to the normal buffers
+func (bs *BufferSystem) Commit() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.stageFlip == nil {
+		return fmt.Errorf("nothing staged")
+	}
+	rl.DrawRenderBatchActive()
+	rl.UpdateTexture(bs.flipBuffers[0].Texture, ReadBufferColors(bs.stageFlip))
+	rl.UpdateTexture(bs.layerBuffers[0].Texture, ReadBufferColors(bs.stageLayer))
+	rl.UnloadRenderTexture(*bs.stageFlip)
+	rl.UnloadRenderTexture(*bs.stageLayer)
+	bs.stageFlip, bs.stageLayer = nil, nil
+	return nil
+}
+
+// Buffer returns flip or layer buffer n
+func (bs *BufferSystem) Buffer(kind string, n int) (*rl.RenderTexture2D, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	var list []*rl.RenderTexture2D
+	switch kind {
+	case "flip":
+		list = bs.flipBuffers
+	case "layer":
+		list = bs.layerBuffers
+	default:
+		return nil, fmt.Errorf("buffer type must be flip or layer")
+	}
+	if n < 0 || n >= len(list) {
+		return nil, fmt.Errorf("invalid buffer index")
+	}
+	return list[n], nil
+}
+
 // SwapFlip swaps flip buffer n with buffer 0
 func (bs *BufferSystem) SwapFlip(n int) error {
 	bs.mu.Lock()
@@ -106,6 +276,81 @@ func (bs *BufferSystem) SwapLayer(n int) error {
 	return nil
 }
 
+// RotateFlip shifts the flip buffers by step places, so buffer step is
+// shown next and the old front buffer moves to the back; -1 goes the
+// other way
+func (bs *BufferSystem) RotateFlip(step int) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	rotateBuffers(bs.flipBuffers, step)
+}
+
+// RotateLayer shifts the layer buffers by step places, as RotateFlip does
+func (bs *BufferSystem) RotateLayer(step int) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	rotateBuffers(bs.layerBuffers, step)
+}
+
+// SetSwapChain makes flip buffers 0 to n-1 a swap chain, or turns the
+// chain off when n is 0
+func (bs *BufferSystem) SetSwapChain(n int) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if n != 0 && (n < 2 || n > len(bs.flipBuffers)) {
+		return fmt.Errorf("swap chain must be 2 to %d buffers", len(bs.flipBuffers))
+	}
+	bs.chain = n
+	return nil
+}
+
+// SwapChain returns the length of the swap chain, 0 when off
+func (bs *BufferSystem) SwapChain() int {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return bs.chain
+}
+
+// AdvanceSwapChain shows the next buffer in the chain: buffer 1 moves to 0
+// and the one that was shown goes to the end of the chain. It returns the
+// index the shown buffer moved to.
+func (bs *BufferSystem) AdvanceSwapChain() (int, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.chain == 0 {
+		return 0, fmt.Errorf("no swap chain set")
+	}
+	rotateBuffers(bs.flipBuffers[:bs.chain], 1)
+	return bs.chain - 1, nil
+}
+
+// rotateBuffers rotates bufs left by step, wrapping around
+func rotateBuffers(bufs []*rl.RenderTexture2D, step int) {
+	n := len(bufs)
+	step = ((step % n) + n) % n
+	rotated := append(append([]*rl.RenderTexture2D{}, bufs[step:]...), bufs[:step]...)
+	copy(bufs, rotated)
+}
+
+// ActiveTarget returns the index of the buffer pair being drawn to
+func (bs *BufferSystem) ActiveTarget() int {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return bs.activeTarget
+}
+
+// TargetState returns the flip and layer buffer numbers being drawn to, and
+// whether drawing into each is hidden from view: a buffer other than 0, or
+// the staging pair
+func (bs *BufferSystem) TargetState() (flip, layer int, offscreenFlip, offscreenLayer bool) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	hidden := bs.activeTarget != 0
+	return bs.activeTarget, bs.activeTarget, hidden || bs.stageFlip != nil, hidden || bs.stageLayer != nil
+}
+
 // SetActiveTarget sets which buffer pair to draw to
 func (bs *BufferSystem) SetActiveTarget(n int) error {
 	bs.mu.Lock()
@@ -119,22 +364,124 @@ func (bs *BufferSystem) SetActiveTarget(n int) error {
 	return nil
 }
 
-// ClearFlip clears the active flip buffer to paper color
+// ClearFlip clears the active flip buffer to its background colour. The
+// hidden buffer used while staging takes buffer 0's, which it will replace.
 func (bs *BufferSystem) ClearFlip() {
-	flip, _ := bs.GetTargetBuffers()
+	bs.mu.RLock()
+	if bs.stageFlip != nil {
+		flip := bs.stageFlip
+		colour := backgroundColour(bs.flipBg[0], palette[effectivePaperColor()])
+		bs.mu.RUnlock()
+		rl.BeginTextureMode(*flip)
+		rl.ClearBackground(colour)
+		rl.EndTextureMode()
+		return
+	}
+	n := bs.activeTarget
+	bs.mu.RUnlock()
+	bs.ClearFlipIndex(n)
+}
+
+// ClearFlipIndex clears flip buffer n to its background colour
+func (bs *BufferSystem) ClearFlipIndex(n int) {
+	bs.mu.RLock()
+	flip := bs.flipBuffers[n]
+	colour := backgroundColour(bs.flipBg[n], palette[effectivePaperColor()])
+	bs.mu.RUnlock()
 	rl.BeginTextureMode(*flip)
-	rl.ClearBackground(palette[effectivePaperColor()])
+	rl.ClearBackground(colour)
 	rl.EndTextureMode()
 }
 
-// ClearLayer clears the active layer buffer to transparent
+// ClearLayer clears the active layer buffer to its background colour
 func (bs *BufferSystem) ClearLayer() {
-	_, layer := bs.GetTargetBuffers()
+	bs.mu.RLock()
+	layer := bs.layerBuffers[bs.activeTarget]
+	colour := backgroundColour(bs.layerBg[bs.activeTarget], rl.Color{R: 0, G: 0, B: 0, A: 0})
+	if bs.stageLayer != nil {
+		layer = bs.stageLayer
+		colour = backgroundColour(bs.layerBg[0], rl.Color{R: 0, G: 0, B: 0, A: 0})
+	}
+	bs.mu.RUnlock()
 	rl.BeginTextureMode(*layer)
+	rl.ClearBackground(colour)
+	rl.EndTextureMode()
+}
+
+// backgroundColour returns the colour a buffer clears to, given its
+// background setting and the colour used when none is set
+func backgroundColour(setting int, fallback rl.Color) rl.Color {
+	if setting == -1 {
+		return fallback
+	}
+	return palette[resolveColour(setting)]
+}
+
+// SetBackground sets the colour cls clears flip or layer buffer n to; -1
+// goes back to paper for flip buffers and transparent for layers
+func (bs *BufferSystem) SetBackground(kind string, n, colour int) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	list := bs.flipBg
+	if kind == "layer" {
+		list = bs.layerBg
+	}
+	if n < 0 || n >= len(list) {
+		return fmt.Errorf("invalid buffer index")
+	}
+	list[n] = colour
+	return nil
+}
+
+// Background returns the background setting of flip or layer buffer n
+func (bs *BufferSystem) Background(kind string, n int) (int, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	list := bs.flipBg
+	if kind == "layer" {
+		list = bs.layerBg
+	}
+	if n < 0 || n >= len(list) {
+		return 0, fmt.Errorf("invalid buffer index")
+	}
+	return list[n], nil
+}
+
+// inheritBackgrounds takes over the background settings of a buffer system
+// being replaced and clears the flip buffers to them
+func (bs *BufferSystem) inheritBackgrounds(old *BufferSystem) {
+	old.mu.RLock()
+	copy(bs.flipBg, old.flipBg)
+	copy(bs.layerBg, old.layerBg)
+	old.mu.RUnlock()
+	if noClear {
+		return
+	}
+	for i := range bs.flipBuffers {
+		bs.ClearFlipIndex(i)
+	}
+}
+
+// ClearPreview clears the preview layer to transparent
+func (bs *BufferSystem) ClearPreview() {
+	rl.BeginTextureMode(*bs.preview)
 	rl.ClearBackground(rl.Color{R: 0, G: 0, B: 0, A: 0})
 	rl.EndTextureMode()
 }
 
+// PreviewTarget returns the preview layer for drawing, clearing it first if
+// this is the first preview draw of the frame, so each frame's preview
+// replaces the last
+func (bs *BufferSystem) PreviewTarget() *rl.RenderTexture2D {
+	if bs.previewFrame != frameCount {
+		bs.ClearPreview()
+		bs.previewFrame = frameCount
+	}
+	return bs.preview
+}
+
 // CreateTextureFromBuffer creates a texture from a region of a buffer
 func CreateTextureFromBuffer(source *rl.RenderTexture2D, region CaptureRegion) (int, error) {
 	// Find a free texture slot
@@ -150,6 +497,10 @@ func CreateTextureFromBuffer(source *rl.RenderTexture2D, region CaptureRegion) (
 		return -1, fmt.Errorf("invalid region bounds")
 	}
 
+	if err := checkTextureBudget(region.Width, region.Height); err != nil {
+		return -1, err
+	}
+
 	// Get pixel data from the region
 	rl.BeginTextureMode(*source)
 	img := rl.LoadImageFromTexture(source.Texture)
@@ -170,10 +521,45 @@ func CreateTextureFromBuffer(source *rl.RenderTexture2D, region CaptureRegion) (
 		height:  region.Height,
 		inUse:   true,
 	}
+	textureBytes += textureCost(region.Width, region.Height)
 
 	return slot, nil
 }
 
+// GrabScreen composites the visible flip and layer buffers into a new
+// texture slot, capturing what is on screen rather than a single buffer
+func GrabScreen(bs *BufferSystem) (int, error) {
+	flip, layer := bs.GetDisplayBuffers()
+	width, height := flip.Texture.Width, flip.Texture.Height
+
+	scratch := rl.LoadRenderTexture(width, height)
+	defer rl.UnloadRenderTexture(scratch)
+
+	// Both buffers are stored upside down, so draw them flipped as the
+	// render loop does; scratch then matches the buffers' orientation
+	src := rl.Rectangle{X: 0, Y: 0, Width: float32(width), Height: -float32(height)}
+	dst := rl.Rectangle{X: 0, Y: 0, Width: float32(width), Height: float32(height)}
+	rl.BeginTextureMode(scratch)
+	rl.ClearBackground(rl.Color{R: 0, G: 0, B: 0, A: 0})
+	rl.DrawTexturePro(flip.Texture, src, dst, rl.Vector2{}, 0, rl.White)
+	rl.DrawTexturePro(layer.Texture, src, dst, rl.Vector2{}, 0, rl.White)
+	rl.EndTextureMode()
+
+	return CreateTextureFromBuffer(&scratch, CaptureRegion{Width: int(width), Height: int(height)})
+}
+
+// ReadPixel reads back the colour of a single pixel from a buffer
+func ReadPixel(source *rl.RenderTexture2D, x, y int) (rl.Color, error) {
+	w, h := int(source.Texture.Width), int(source.Texture.Height)
+	if x < 0 || y < 0 || x >= w || y >= h {
+		return rl.Color{}, fmt.Errorf("pixel %d,%d outside buffer", x, y)
+	}
+	img := rl.LoadImageFromTexture(source.Texture)
+	defer rl.UnloadImage(img)
+	// Render textures are stored upside down
+	return rl.GetImageColor(*img, int32(x), int32(h-1-y)), nil
+}
+
 // CreateTextureFromPixelData creates a texture from provided hex string data
 func CreateTextureFromPixelData(pixelData string, width, height int) (int, error) {
 	// Find a free texture slot
@@ -182,42 +568,41 @@ func CreateTextureFromPixelData(pixelData string, width, height int) (int, error
 		return -1, fmt.Errorf("no free texture slots")
 	}
 
+	if err := checkTextureSize(width, height); err != nil {
+		return -1, err
+	}
+
 	// Validate data length
 	if len(pixelData) != width*height {
 		return -1, fmt.Errorf("pixel data length (%d) does not match dimensions %dx%d", len(pixelData), width, height)
 	}
 
+	if err := checkTextureBudget(width, height); err != nil {
+		return -1, err
+	}
+
 	// Create image data
 	imgData := make([]rl.Color, width*height)
 	for i, ch := range pixelData {
-		var idx int
-		switch ch {
-		case '.':
+		idx, mapped := lookupPixelChar(ch)
+		if mapped && idx == pixelTransparent {
 			// Transparent pixel
 			imgData[i] = rl.Color{R: 0, G: 0, B: 0, A: 0}
 			continue
-		case '@':
-			// Light grey (palette index 7)
-			idx = 7
-		case '%':
-			// White (palette index 15)
-			idx = 15
-		case '`':
-			// Black (palette index 0)
-			idx = 0
-		default:
+		}
+		if !mapped {
 			// Try to parse as hex
 			val, err := strconv.ParseInt(string(ch), 16, 64)
 			if err != nil {
-				return -1, fmt.Errorf("invalid character %q - must be hex digit or one of: . @ % `", ch)
+				return -1, fmt.Errorf("invalid character %q - must be hex digit or a texmap character", ch)
 			}
 			if val < 0 || val > 15 {
 				return -1, fmt.Errorf("hex value %d out of range", val)
 			}
 			idx = int(val)
 		}
-		if idx >= len(palette) {
-			idx = len(palette) - 1
+		if idx >= brightBlack {
+			idx = brightBlack - 1
 		}
 		imgData[i] = palette[idx]
 	}
@@ -232,6 +617,9 @@ func CreateTextureFromPixelData(pixelData string, width, height int) (int, error
 	}
 	tex := rl.LoadTextureFromImage(image)
 	rl.UnloadImage(image)
+	if tex.ID == 0 {
+		return -1, fmt.Errorf("the GPU could not create a %dx%d texture", width, height)
+	}
 
 	// Store in texture system
 	textures[slot] = TextureEntry{
@@ -240,10 +628,115 @@ func CreateTextureFromPixelData(pixelData string, width, height int) (int, error
 		height:  height,
 		inUse:   true,
 	}
+	textureBytes += textureCost(width, height)
 
 	return slot, nil
 }
 
+// CreateTexturesFromSheet loads an image file and slices it into a grid of
+// tileW×tileH textures, returning their slots in row-major order. Slots and
+// memory are checked up front so a sheet is either loaded whole or not at all.
+func CreateTexturesFromSheet(path string, tileW, tileH int) ([]int, error) {
+	if err := checkTextureSize(tileW, tileH); err != nil {
+		return nil, err
+	}
+	img := rl.LoadImage(path)
+	if !rl.IsImageValid(img) {
+		return nil, fmt.Errorf("cannot load image %s", path)
+	}
+	defer rl.UnloadImage(img)
+
+	w, h := int(img.Width), int(img.Height)
+	if w%tileW != 0 || h%tileH != 0 {
+		return nil, fmt.Errorf("image size %dx%d is not a multiple of %dx%d", w, h, tileW, tileH)
+	}
+	cols, rows := w/tileW, h/tileH
+
+	free := 0
+	for i := range textures {
+		if !textures[i].inUse {
+			free++
+		}
+	}
+	if free < cols*rows {
+		return nil, fmt.Errorf("no free texture slots")
+	}
+	if maxTextureBytes > 0 && textureBytes+cols*rows*textureCost(tileW, tileH) > maxTextureBytes {
+		return nil, fmt.Errorf("texture memory limit exceeded")
+	}
+
+	slots := make([]int, 0, cols*rows)
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			tile := rl.ImageFromImage(*img, rl.Rectangle{
+				X:      float32(col * tileW),
+				Y:      float32(row * tileH),
+				Width:  float32(tileW),
+				Height: float32(tileH),
+			})
+			tex := rl.LoadTextureFromImage(&tile)
+			rl.UnloadImage(&tile)
+			if tex.ID == 0 {
+				// Give back the tiles already made, keeping the sheet all or nothing
+				for _, slot := range slots {
+					freeTextureSlot(slot)
+				}
+				return nil, fmt.Errorf("the GPU could not create a %dx%d texture", tileW, tileH)
+			}
+			slot := findFirstFreeTextureSlot()
+			textures[slot] = TextureEntry{
+				texture: tex,
+				width:   tileW,
+				height:  tileH,
+				inUse:   true,
+			}
+			textureBytes += textureCost(tileW, tileH)
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+// textureCost returns the GPU memory used by an RGBA texture
+func textureCost(width, height int) int {
+	return width * height * 4
+}
+
+// maxTextureSize is the longest texture side accepted. GPUs refuse larger
+// textures without an error raylib can see, so ask no more than any of
+// them supports.
+const maxTextureSize = 4096
+
+// checkTextureSize reports whether a texture of the given size can be made
+func checkTextureSize(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid texture parameters")
+	}
+	if width > maxTextureSize || height > maxTextureSize {
+		return fmt.Errorf("texture %dx%d is over the %dx%d size limit", width, height, maxTextureSize, maxTextureSize)
+	}
+	return nil
+}
+
+// checkTextureBudget reports whether a texture of the given size fits
+// within the configured texture memory limit
+func checkTextureBudget(width, height int) error {
+	if maxTextureBytes > 0 && textureBytes+textureCost(width, height) > maxTextureBytes {
+		return fmt.Errorf("texture memory limit exceeded")
+	}
+	return nil
+}
+
+// freeTextureSlot unloads the texture in a slot and releases its memory
+func freeTextureSlot(n int) {
+	if !textures[n].inUse {
+		return
+	}
+	rl.UnloadTexture(textures[n].texture)
+	textureBytes -= textureCost(textures[n].width, textures[n].height)
+	textures[n] = TextureEntry{}
+}
+
 // findFirstFreeTextureSlot returns the index of the first free texture slot
 func findFirstFreeTextureSlot() int {
 	for i := 0; i < len(textures); i++ {
@@ -254,11 +747,32 @@ func findFirstFreeTextureSlot() int {
 	return -1
 }
 
+// texturesInUse returns how many texture slots are occupied
+func texturesInUse() int {
+	n := 0
+	for i := range textures {
+		if textures[i].inUse {
+			n++
+		}
+	}
+	return n
+}
+
 // Cleanup releases all buffer resources
 func (bs *BufferSystem) Cleanup() {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
+	bs.releaseRenderTextures()
+
+	// Cleanup textures
+	for i := 0; i < len(textures); i++ {
+		freeTextureSlot(i)
+	}
+}
+
+// releaseRenderTextures unloads the buffers' render textures
+func (bs *BufferSystem) releaseRenderTextures() {
 	for i := 0; i < len(bs.flipBuffers); i++ {
 		if bs.flipBuffers[i] != nil {
 			rl.UnloadRenderTexture(*bs.flipBuffers[i])
@@ -267,12 +781,112 @@ func (bs *BufferSystem) Cleanup() {
 			rl.UnloadRenderTexture(*bs.layerBuffers[i])
 		}
 	}
+	if bs.preview != nil {
+		rl.UnloadRenderTexture(*bs.preview)
+	}
+	if bs.stageFlip != nil {
+		rl.UnloadRenderTexture(*bs.stageFlip)
+		rl.UnloadRenderTexture(*bs.stageLayer)
+	}
+}
 
-	// Cleanup textures
-	for i := 0; i < len(textures); i++ {
-		if textures[i].inUse {
-			rl.UnloadTexture(textures[i].texture)
-			textures[i] = TextureEntry{}
+// Release frees the render textures of a buffer system that has been
+// replaced, leaving the texture slots to the new one
+func (bs *BufferSystem) Release() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	rl.DrawRenderBatchActive()
+	bs.releaseRenderTextures()
+}
+
+// ReadBufferColors reads back a buffer's pixels into a Go-owned slice.
+// Rows are in texture order, which is upside down relative to the display.
+func ReadBufferColors(source *rl.RenderTexture2D) []rl.Color {
+	img := rl.LoadImageFromTexture(source.Texture)
+	defer rl.UnloadImage(img)
+	colors := rl.LoadImageColors(img)
+	defer rl.UnloadImageColors(colors)
+	return append([]rl.Color(nil), colors...)
+}
+
+// TransformRegion reads back a buffer, replaces each pixel of a region
+// (clipped to the buffer) with fn's result and uploads it again
+func TransformRegion(rt *rl.RenderTexture2D, x, y, w, h int, fn func(rl.Color) rl.Color) {
+	bw, bh := int(rt.Texture.Width), int(rt.Texture.Height)
+	x0, y0 := max(x, 0), max(y, 0)
+	x1, y1 := min(x+w, bw), min(y+h, bh)
+	if x0 >= x1 || y0 >= y1 {
+		return
+	}
+	pixels := ReadBufferColors(rt)
+	for py := y0; py < y1; py++ {
+		// Render textures are stored upside down
+		row := (bh - 1 - py) * bw
+		for px := x0; px < x1; px++ {
+			pixels[row+px] = fn(pixels[row+px])
+		}
+	}
+	rl.UpdateTexture(rt.Texture, pixels)
+}
+
+// HashBuffer returns an FNV-1a hash of a buffer's pixels
+func HashBuffer(source *rl.RenderTexture2D) uint64 {
+	h := fnv.New64a()
+	for _, c := range ReadBufferColors(source) {
+		h.Write([]byte{c.R, c.G, c.B, c.A})
+	}
+	return h.Sum64()
+}
+
+// bufferWatch periodically hashes a buffer to detect changes
+type bufferWatch struct {
+	kind     string
+	index    int
+	interval time.Duration
+	next     time.Time
+	hash     uint64
+	primed   bool // hash holds a previous reading
+}
+
+// bufferWatches are keyed by "kind index"; only touched by the main loop
+var bufferWatches = map[string]*bufferWatch{}
+
+// setBufferWatch starts, changes or (with interval 0) stops a buffer watch
+func setBufferWatch(kind string, index, intervalMs int) error {
+	if _, err := buffers.Buffer(kind, index); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s %d", kind, index)
+	if intervalMs <= 0 {
+		delete(bufferWatches, key)
+		return nil
+	}
+	bufferWatches[key] = &bufferWatch{
+		kind:     kind,
+		index:    index,
+		interval: time.Duration(intervalMs) * time.Millisecond,
+	}
+	return nil
+}
+
+// checkBufferWatches hashes each watched buffer that is due and sends a
+// "changed" event when its contents differ from the last check
+func checkBufferWatches() {
+	now := time.Now()
+	for _, w := range bufferWatches {
+		if now.Before(w.next) {
+			continue
+		}
+		w.next = now.Add(w.interval)
+		rt, err := buffers.Buffer(w.kind, w.index)
+		if err != nil {
+			continue
+		}
+		hash := HashBuffer(rt)
+		if w.primed && hash != w.hash {
+			sendTopicEvent("changed", fmt.Sprintf("changed: %s %d", w.kind, w.index))
 		}
+		w.hash, w.primed = hash, true
 	}
 }
\ No newline at end of file
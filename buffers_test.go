@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckTextureSize(t *testing.T) {
+	for _, tc := range []struct {
+		width, height int
+		ok            bool
+	}{
+		{1, 1, true},
+		{4096, 4096, true},
+		{4097, 1, false},
+		{1, 4097, false},
+		{0, 16, false},
+		{16, 0, false},
+		{-1, 16, false},
+		{16, -1, false},
+	} {
+		err := checkTextureSize(tc.width, tc.height)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkTextureSize(%d, %d) = %v, want ok %v", tc.width, tc.height, err, tc.ok)
+		}
+	}
+}
@@ -2,16 +2,253 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
+	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
 // DrawCommand represents a drawing or control instruction
 type DrawCommand struct {
-	Cmd    string   // Command name
-	Params []int    // Numeric parameters
-	Mode   string   // Mode flags ("S"/"F"/"T" for shapes, "flip"/"layer" for paint)
-	Str    string   // String data (used for texture data)
+	Cmd     string          // Command name
+	Params  []int           // Numeric parameters
+	Mode    string          // Mode flags ("S"/"F"/"T" for shapes, "flip"/"layer" for paint)
+	Str     string          // String data (used for texture data)
+	Conn    net.Conn        // Originating connection, for replies from the main loop
+	State   *connState      // Per-connection drawing state, nil for internal commands
+	Queued  time.Time       // When the command was queued (used by bench)
+	Target  string          // "flip" or "layer" to override the drawing mode for this command
+	Body    []string        // Command lines of a macro definition
+	Args    []string        // Macro parameter names, or the arguments of a call
+	Colours *colourOverride // Colours for this command only, from a /ink /paper /bright suffix
+}
+
+// colourOverride replaces the ink, paper and bright settings for a single
+// command; -1 leaves a setting alone
+type colourOverride struct {
+	ink, paper, bright int
+}
+
+// apply sets the overridden colours and returns a function restoring the
+// previous ones. Registers are read now, as the ink and paper commands
+// read them; nothing changes if either colour is out of range.
+func (o *colourOverride) apply() (func(), error) {
+	ink, paper, bright := defaultInk, defaultPaper, defaultBright
+	newInk, newPaper := ink, paper
+	var err error
+	if o.ink != -1 {
+		if newInk, err = storedColour(o.ink); err != nil {
+			return nil, fmt.Errorf("/ink: %v", err)
+		}
+	}
+	if o.paper != -1 {
+		if newPaper, err = storedColour(o.paper); err != nil {
+			return nil, fmt.Errorf("/paper: %v", err)
+		}
+	}
+	defaultInk, defaultPaper = newInk, newPaper
+	if o.bright != -1 {
+		defaultBright = o.bright == 1
+	}
+	return func() {
+		defaultInk, defaultPaper, defaultBright = ink, paper, bright
+	}, nil
+}
+
+// colourOverrideSuffix matches one trailing /ink, /paper or /bright option
+var colourOverrideSuffix = regexp.MustCompile(`(?i)\s+/(ink|paper|bright)\s+(\S+)\s*$`)
+
+// splitColourOverride removes any /ink N /paper M /bright B options from the
+// end of a command line, returning what is left and the options, or a nil
+// override if there were none
+func splitColourOverride(line string) (string, *colourOverride, error) {
+	var o *colourOverride
+	for {
+		m := colourOverrideSuffix.FindStringSubmatchIndex(line)
+		if m == nil {
+			return line, o, nil
+		}
+		if o == nil {
+			o = &colourOverride{-1, -1, -1}
+		}
+		name, token := strings.ToLower(line[m[2]:m[3]]), line[m[4]:m[5]]
+		val, err := convertToken(token)
+		if err != nil || val == -1 {
+			return "", nil, fmt.Errorf("invalid /%s value %q", name, token)
+		}
+		switch name {
+		case "ink":
+			o.ink = val
+		case "paper":
+			o.paper = val
+		case "bright":
+			if val != 0 && val != 1 {
+				return "", nil, fmt.Errorf("/bright must be 0 or 1")
+			}
+			o.bright = val
+		}
+		line = line[:m[0]]
+	}
+}
+
+// targetsLayer reports whether a command draws into the layer buffer,
+// honouring a per-command target prefix over the current drawing mode
+func targetsLayer(cmd DrawCommand) bool {
+	if cmd.Target != "" {
+		return cmd.Target == "layer"
+	}
+	return currentDrawingMode == "layer"
+}
+
+// mainThreadQueries lists queries that read raylib or palette state and so
+// must be answered from the render loop rather than the connection goroutine
+var mainThreadQueries = map[string]bool{
+	"perf":       true,
+	"nearest":    true,
+	"origin":     true,
+	"getpixel":   true,
+	"focus":      true,
+	"palette":    true,
+	"scene":      true,
+	"state":      true,
+	"tint":       true,
+	"seed":       true,
+	"indexed":    true,
+	"caps":       true,
+	"pos":        true,
+	"stat":       true,
+	"lasterror":  true,
+	"stencil":    true,
+	"dumpregion": true,
+	"refresh":    true,
+	"timers":     true,
+}
+
+// commandNames lists the commands the drawing port accepts, for commands?
+var commandNames = []string{
+	"adjust",
+	"beginframe",
+	"bench",
+	"bgcolour",
+	"bright",
+	"circle",
+	"clearonflip",
+	"cls",
+	"clsflip",
+	"clslayer",
+	"colour",
+	"commit",
+	"crossfade",
+	"cyclecolours",
+	"drawimage",
+	"echo",
+	"ellipse",
+	"endframe",
+	"eraser",
+	"flip",
+	"gammablend",
+	"graphics",
+	"indexed",
+	"ink",
+	"invertregion",
+	"layer",
+	"line",
+	"linef",
+	"linestyle",
+	"lineto",
+	"loadpalette",
+	"macro",
+	"mirrordraw",
+	"mouseevents",
+	"moveto",
+	"ngon",
+	"notify",
+	"origin",
+	"oval",
+	"paint",
+	"panel",
+	"paper",
+	"pause",
+	"penmask",
+	"plot",
+	"plotf",
+	"preview",
+	"printrot",
+	"progress",
+	"rect",
+	"rects",
+	"resume",
+	"ring",
+	"roundrect4",
+	"savepalette",
+	"scene",
+	"screenshot",
+	"seed",
+	"setcol",
+	"shade",
+	"spline",
+	"stage",
+	"star",
+	"stencil",
+	"swapchain",
+	"sync",
+	"tex",
+	"texmap",
+	"texsheet",
+	"tint",
+	"trackmouse",
+	"triangle",
+	"trigrad",
+	"trueblack",
+	"vblank",
+	"vflip",
+	"watchbuffer",
+	"wrap",
+}
+
+// commandAliases maps single-letter shorthands, in the spirit of ZX BASIC
+// keywords, to the commands they stand for
+var commandAliases = map[string]string{
+	"p": "plot",
+	"l": "line",
+	"c": "circle",
+	"r": "rect",
+	"t": "triangle",
+	"i": "ink",
+	"b": "bright",
+	"o": "origin",
+	"f": "flip",
+}
+
+func init() {
+	known := map[string]bool{}
+	for _, name := range commandNames {
+		known[name] = true
+	}
+	for alias, name := range commandAliases {
+		if known[alias] || !known[name] {
+			panic(fmt.Sprintf("command alias %q for %q is invalid", alias, name))
+		}
+	}
+}
+
+// commandList returns the command names with their aliases, e.g. "circle/c"
+func commandList() string {
+	aliases := map[string]string{}
+	for alias, name := range commandAliases {
+		aliases[name] = alias
+	}
+	list := make([]string, len(commandNames))
+	for i, name := range commandNames {
+		list[i] = name
+		if alias, ok := aliases[name]; ok {
+			list[i] += "/" + alias
+		}
+	}
+	return strings.Join(list, " ")
 }
 
 // parseCommand converts a text line into a DrawCommand
@@ -21,16 +258,89 @@ func parseCommand(line string) (DrawCommand, error) {
 		return DrawCommand{}, fmt.Errorf("empty command")
 	}
 	cmd := strings.ToLower(fields[0])
+	if name, ok := commandAliases[cmd]; ok {
+		cmd = name
+		fields[0] = name
+	}
+	// echo returns the rest of the line exactly as it was sent
+	if cmd == "echo" {
+		text := strings.TrimLeft(line, " \t")[len(fields[0]):]
+		if text != "" {
+			text = text[1:]
+		}
+		return DrawCommand{Cmd: "echo", Str: text}, nil
+	}
+	// A /ink /paper /bright suffix sets colours for this command only.
+	// Macro definitions keep theirs for the lines they hold.
+	if cmd != "macro" && fields[len(fields)-1] != "?" {
+		rest, override, err := splitColourOverride(line)
+		if err != nil {
+			return DrawCommand{}, err
+		}
+		if override != nil {
+			dc, err := parseCommand(rest)
+			if err != nil {
+				return dc, err
+			}
+			switch dc.Cmd {
+			case "ink", "paper", "bright", "colour", "macro":
+				return DrawCommand{}, fmt.Errorf("%s does not take colour options", dc.Cmd)
+			}
+			dc.Colours = override
+			return dc, nil
+		}
+	}
+
 	var dc DrawCommand
 	dc.Cmd = cmd
 	dc.Mode = "F" // default mode is fill
 
+	// notify and printrot carry free text, so are parsed from the raw line
+	if cmd == "notify" {
+		return parseNotifyCommand(line)
+	}
+	if cmd == "printrot" {
+		return parsePrintRotCommand(line)
+	}
+
 	// Handle query commands
 	if len(fields) > 0 && fields[len(fields)-1] == "?" {
 		fields = fields[:len(fields)-1]
 		return parseQueryCommand(fields)
 	}
 
+	// Macro bodies hold whole command lines
+	if cmd == "macro" {
+		return parseMacroCommand(fields)
+	}
+
+	// flip/layer next|prev page through all the buffers in turn
+	if (cmd == "flip" || cmd == "layer") && len(fields) == 2 {
+		if page := strings.ToLower(fields[1]); page == "next" || page == "prev" {
+			return DrawCommand{Cmd: cmd, Mode: page}, nil
+		}
+	}
+
+	// A leading flip/layer followed by a command word targets that buffer
+	// for this command only, e.g. "layer plot 10 10 3"
+	if (cmd == "flip" || cmd == "layer") && len(fields) > 1 {
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			inner, err := parseCommand(strings.Join(fields[1:], " "))
+			if err != nil {
+				return inner, err
+			}
+			if inner.Mode == "query" {
+				return DrawCommand{}, fmt.Errorf("%s prefix cannot be used with a query", cmd)
+			}
+			// echo draws nothing, and its text has lost its spacing here
+			if inner.Cmd == "echo" {
+				return DrawCommand{}, fmt.Errorf("%s prefix cannot be used with echo", cmd)
+			}
+			inner.Target = cmd
+			return inner, nil
+		}
+	}
+
 	// Handle texture commands
 	if cmd == "tex" {
 		return parseTextureCommand(fields)
@@ -45,6 +355,138 @@ func parseCommand(line string) (DrawCommand, error) {
 	return parseRegularCommand(cmd, fields)
 }
 
+// pageStep returns how far flip/layer next|prev rotate the buffers
+func pageStep(page string) int {
+	if page == "prev" {
+		return -1
+	}
+	return 1
+}
+
+// parseMacroCommand parses macro define name [$p ... =] cmd ; cmd ...,
+// macro call name [args] and macro del name. Lines of a definition without
+// parameters must parse on their own; the rest are checked when called.
+func parseMacroCommand(fields []string) (DrawCommand, error) {
+	if len(fields) < 3 {
+		return DrawCommand{}, fmt.Errorf("macro requires define, call or del and a name")
+	}
+	action := strings.ToLower(fields[1])
+	name := fields[2]
+	switch action {
+	case "call":
+		return DrawCommand{Cmd: "macro", Mode: action, Str: name, Args: fields[3:]}, nil
+	case "del":
+		if len(fields) != 3 {
+			return DrawCommand{}, fmt.Errorf("macro del takes only a name")
+		}
+		return DrawCommand{Cmd: "macro", Mode: action, Str: name}, nil
+	case "define":
+		rest := fields[3:]
+		var params []string
+		for i, f := range rest {
+			if f == "=" {
+				params, rest = rest[:i], rest[i+1:]
+				break
+			}
+		}
+		seen := map[string]bool{}
+		for _, p := range params {
+			if !validMacroParam(p) {
+				return DrawCommand{}, fmt.Errorf("macro %s: invalid parameter %q", name, p)
+			}
+			if seen[p] {
+				return DrawCommand{}, fmt.Errorf("macro %s: parameter %s repeated", name, p)
+			}
+			seen[p] = true
+		}
+
+		var body []string
+		for _, part := range strings.Split(strings.Join(rest, " "), ";") {
+			line := strings.TrimSpace(part)
+			if line == "" {
+				continue
+			}
+			if len(params) == 0 {
+				inner, err := parseCommand(line)
+				if err != nil {
+					return DrawCommand{}, fmt.Errorf("macro %s: %q: %v", name, line, err)
+				}
+				if inner.Cmd == "macro" && inner.Mode != "call" {
+					return DrawCommand{}, fmt.Errorf("macro %s: macros can only call other macros", name)
+				}
+			} else if f := strings.Fields(line); strings.EqualFold(f[0], "macro") &&
+				(len(f) < 2 || !strings.EqualFold(f[1], "call")) {
+				return DrawCommand{}, fmt.Errorf("macro %s: macros can only call other macros", name)
+			}
+			body = append(body, line)
+		}
+		if len(body) == 0 {
+			return DrawCommand{}, fmt.Errorf("macro %s has no commands", name)
+		}
+		return DrawCommand{Cmd: "macro", Mode: action, Str: name, Body: body, Args: params}, nil
+	}
+	return DrawCommand{}, fmt.Errorf("unknown macro action %q", fields[1])
+}
+
+// lineText returns the free text that follows the first skip fields of a
+// command line, kept verbatim. Quotes around it are optional and allow
+// Go-style escapes.
+func lineText(line string, skip int, cmd string) (string, error) {
+	text := strings.TrimSpace(line)
+	for i := 0; i < skip; i++ {
+		end := strings.IndexAny(text, " \t")
+		if end < 0 {
+			text = ""
+			break
+		}
+		text = strings.TrimSpace(text[end:])
+	}
+	if strings.HasPrefix(text, "\"") {
+		unquoted, err := strconv.Unquote(text)
+		if err != nil {
+			return "", fmt.Errorf("%s text has mismatched quotes", cmd)
+		}
+		text = unquoted
+	}
+	if text == "" {
+		return "", fmt.Errorf("%s requires text", cmd)
+	}
+	if strings.ContainsAny(text, "\r\n") {
+		return "", fmt.Errorf("%s text must be a single line", cmd)
+	}
+	return text, nil
+}
+
+// parseNotifyCommand parses notify "text"
+func parseNotifyCommand(line string) (DrawCommand, error) {
+	text, err := lineText(line, 1, "notify")
+	if err != nil {
+		return DrawCommand{}, err
+	}
+	return DrawCommand{Cmd: "notify", Str: text}, nil
+}
+
+// parsePrintRotCommand parses printrot x y angle "text"
+func parsePrintRotCommand(line string) (DrawCommand, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return DrawCommand{}, fmt.Errorf("printrot requires x y angle and text")
+	}
+	params := []int{}
+	for _, token := range fields[1:4] {
+		val, err := strconv.Atoi(token)
+		if err != nil {
+			return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+		}
+		params = append(params, val)
+	}
+	text, err := lineText(line, 4, "printrot")
+	if err != nil {
+		return DrawCommand{}, err
+	}
+	return DrawCommand{Cmd: "printrot", Params: params, Str: text}, nil
+}
+
 func parseTextureCommand(fields []string) (DrawCommand, error) {
 	if len(fields) < 2 {
 		return DrawCommand{}, fmt.Errorf("invalid texture command")
@@ -96,10 +538,16 @@ func parseTextureCommand(fields []string) (DrawCommand, error) {
 		}
 		dc.Params = append(dc.Params, n)
 
-	case "paint":
-		// tex paint x y n
+	case "grabscreen":
+		// tex grabscreen
+		if len(fields) != 2 {
+			return dc, fmt.Errorf("tex grabscreen takes no parameters")
+		}
+
+	case "paint", "stampc":
+		// tex paint x y n, or tex stampc x y n to centre on x,y
 		if len(fields) < 5 {
-			return dc, fmt.Errorf("insufficient parameters for tex paint")
+			return dc, fmt.Errorf("insufficient parameters for tex %s", dc.Mode)
 		}
 		x, err := strconv.Atoi(fields[2])
 		if err != nil {
@@ -116,12 +564,56 @@ func parseTextureCommand(fields []string) (DrawCommand, error) {
 		dc.Params = append(dc.Params, x, y, n)
 
 	default:
-		return dc, fmt.Errorf("unknown texture command mode: %s", dc.Mode)
+		return dc, unknownSubcommandError("tex", dc.Mode, texSubcommands)
 	}
 
 	return dc, nil
 }
 
+// texSubcommands lists the valid "tex" sub-commands, for error messages
+var texSubcommands = []string{"add", "set", "del", "paint", "stampc", "grabscreen"}
+
+// unknownSubcommandError builds an error listing the valid sub-commands,
+// suggesting the closest one when the input looks like a typo
+func unknownSubcommandError(cmd, sub string, valid []string) error {
+	if guess := closestMatch(sub, valid); guess != "" {
+		return fmt.Errorf("unknown %s sub-command %q, did you mean %q? (valid: %s)", cmd, sub, guess, strings.Join(valid, " "))
+	}
+	return fmt.Errorf("unknown %s sub-command %q (valid: %s)", cmd, sub, strings.Join(valid, " "))
+}
+
+// closestMatch returns the option within edit distance 2 of word, or ""
+func closestMatch(word string, options []string) string {
+	best, bestDist := "", 3
+	for _, opt := range options {
+		if d := editDistance(word, opt); d < bestDist {
+			best, bestDist = opt, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
 func parsePaintCommand(fields []string) (DrawCommand, error) {
 	if len(fields) == 2 {
 		if strings.ToLower(fields[1]) == "flip" {
@@ -145,22 +637,51 @@ func parseQueryCommand(fields []string) (DrawCommand, error) {
 		return DrawCommand{}, fmt.Errorf("empty query command")
 	}
 	
+	// Keep the arguments: numeric ones in Params, and the raw text in Str
+	// for queries that take words
+	params := []int{}
+	for _, token := range fields[1:] {
+		if val, err := convertToken(token); err == nil {
+			params = append(params, val)
+		}
+	}
+
 	return DrawCommand{
-		Cmd: fields[0],
+		Cmd: strings.ToLower(fields[0]),
+		Params: params,
 		Mode: "query",
+		Str: strings.Join(fields[1:], " "),
 	}, nil
 }
 
-func parseRegularCommand(cmd string, fields []string) (DrawCommand, error) {
-	convertToken := func(token string) (int, error) {
-		if token == "_" {
-			return -1, nil
+// convertToken parses a numeric parameter, accepting "_" for the default
+// colour, "rN" for colour register N and "#RRGGBB" for a hex colour
+func convertToken(token string) (int, error) {
+	if token == "_" {
+		return -1, nil
+	}
+	if len(token) == 7 && token[0] == '#' {
+		rgb, err := strconv.ParseUint(token[1:], 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid colour literal %q", token)
 		}
-		return strconv.Atoi(token)
+		return colourLiteralBase + int(rgb), nil
 	}
+	if len(token) > 1 && (token[0] == 'r' || token[0] == 'R') {
+		n, err := strconv.Atoi(token[1:])
+		if err != nil || n < 0 || n >= len(colourRegisters) {
+			return 0, fmt.Errorf("invalid colour register %q", token)
+		}
+		return colourRegisterBase - n, nil
+	}
+	return strconv.Atoi(token)
+}
 
+func parseRegularCommand(cmd string, fields []string) (DrawCommand, error) {
 	switch cmd {
-	case "plot", "line", "lineto", "ink", "paper", "bright", "colour", "cls", "flip", "layer":
+	case "plot", "line", "lineto", "ink", "paper", "bright", "colour", "cls", "flip", "layer", "origin", "setcol", "bench", "sync",
+		"plotf", "linef", "crossfade", "beginframe", "endframe", "invertregion", "moveto", "stage", "commit",
+		"pause", "resume", "graphics":
 		params := []int{}
 		for _, token := range fields[1:] {
 			val, err := convertToken(token)
@@ -171,14 +692,452 @@ func parseRegularCommand(cmd string, fields []string) (DrawCommand, error) {
 		}
 		return DrawCommand{Cmd: cmd, Params: params}, nil
 
-	case "rect", "circle", "triangle":
+	case "spline":
+		// spline colour x1 y1 ... xN yN [closed|filled]
+		mode := "open"
+		tokens := fields[1:]
+		if n := len(tokens); n > 0 {
+			if m := strings.ToLower(tokens[n-1]); m == "closed" || m == "filled" {
+				mode = m
+				tokens = tokens[:n-1]
+			}
+		}
+		if len(tokens)%2 != 1 || len(tokens) < 9 {
+			return DrawCommand{}, fmt.Errorf("spline requires a colour and at least 4 x y points")
+		}
+		params := []int{}
+		for _, token := range tokens {
+			val, err := convertToken(token)
+			if err != nil {
+				return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+			}
+			params = append(params, val)
+		}
+		return DrawCommand{Cmd: cmd, Params: params, Mode: mode}, nil
+
+	case "clsflip", "clslayer":
+		// Shorthand for "flip cls" and "layer cls"
+		if len(fields) != 1 {
+			return DrawCommand{}, fmt.Errorf("%s takes no parameters", cmd)
+		}
+		return DrawCommand{Cmd: "cls", Target: strings.TrimPrefix(cmd, "cls")}, nil
+
+	case "panel":
+		// panel x y w h fillColour borderColour [borderWidth]
+		if len(fields) != 7 && len(fields) != 8 {
+			return DrawCommand{}, fmt.Errorf("panel requires x y w h fillColour borderColour, plus optional border width")
+		}
+		params := []int{}
+		for _, token := range fields[1:] {
+			val, err := convertToken(token)
+			if err != nil {
+				return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+			}
+			params = append(params, val)
+		}
+		if len(params) == 6 {
+			params = append(params, 1)
+		}
+		if params[2] <= 0 || params[3] <= 0 {
+			return DrawCommand{}, fmt.Errorf("panel width and height must be positive")
+		}
+		if params[6] < 1 {
+			return DrawCommand{}, fmt.Errorf("panel border width must be at least 1")
+		}
+		return DrawCommand{Cmd: cmd, Params: params}, nil
+
+	case "rects":
+		// rects colour x1 y1 w1 h1 ... xN yN wN hN
+		if len(fields) < 6 || (len(fields)-2)%4 != 0 {
+			return DrawCommand{}, fmt.Errorf("rects requires a colour and x y w h for each rectangle")
+		}
+		params := []int{}
+		for _, token := range fields[1:] {
+			val, err := convertToken(token)
+			if err != nil {
+				return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+			}
+			params = append(params, val)
+		}
+		for i := 1; i < len(params); i += 4 {
+			if params[i+2] < 0 || params[i+3] < 0 {
+				return DrawCommand{}, fmt.Errorf("rects widths and heights must not be negative")
+			}
+		}
+		return DrawCommand{Cmd: cmd, Params: params}, nil
+
+	case "trigrad":
+		// trigrad x1 y1 c1 x2 y2 c2 x3 y3 c3
+		if len(fields) != 10 {
+			return DrawCommand{}, fmt.Errorf("trigrad requires x y colour for each of three vertices")
+		}
+		params := []int{}
+		for _, token := range fields[1:] {
+			val, err := convertToken(token)
+			if err != nil {
+				return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+			}
+			params = append(params, val)
+		}
+		return DrawCommand{Cmd: cmd, Params: params}, nil
+
+	case "rect", "circle", "triangle", "ngon", "star", "ring", "oval", "roundrect4", "ellipse":
 		return parseShapeCommand(cmd, fields)
 
+	case "shade":
+		// shade x y w h colourA colourB ratio
+		if len(fields) != 8 {
+			return DrawCommand{}, fmt.Errorf("shade requires x y w h colourA colourB ratio")
+		}
+		params := []int{}
+		for _, token := range fields[1:] {
+			val, err := convertToken(token)
+			if err != nil {
+				return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+			}
+			params = append(params, val)
+		}
+		if params[6] < 0 || params[6] > 100 {
+			return DrawCommand{}, fmt.Errorf("shade ratio must be 0-100")
+		}
+		return DrawCommand{Cmd: cmd, Params: params}, nil
+
+	case "progress":
+		// progress x y w h percent [fgColour] [bgColour]
+		if len(fields) < 6 || len(fields) > 8 {
+			return DrawCommand{}, fmt.Errorf("progress requires x y w h percent, plus optional fg and bg colours")
+		}
+		params := []int{}
+		for _, token := range fields[1:] {
+			val, err := convertToken(token)
+			if err != nil {
+				return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+			}
+			params = append(params, val)
+		}
+		for len(params) < 7 {
+			params = append(params, -1)
+		}
+		params[4] = max(0, min(params[4], 100))
+		return DrawCommand{Cmd: cmd, Params: params}, nil
+
+	case "watchbuffer":
+		// watchbuffer flip|layer index intervalMs
+		if len(fields) != 4 {
+			return DrawCommand{}, fmt.Errorf("watchbuffer requires buffer type, index and interval")
+		}
+		kind := strings.ToLower(fields[1])
+		if kind != "flip" && kind != "layer" {
+			return DrawCommand{}, fmt.Errorf("buffer type must be flip or layer")
+		}
+		index, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return DrawCommand{}, fmt.Errorf("invalid buffer index %q", fields[2])
+		}
+		interval, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return DrawCommand{}, fmt.Errorf("invalid interval %q", fields[3])
+		}
+		return DrawCommand{Cmd: cmd, Str: kind, Params: []int{index, interval}}, nil
+
+	case "cyclecolours":
+		// cyclecolours start end intervalMs | cyclecolours off
+		if len(fields) == 2 && strings.ToLower(fields[1]) == "off" {
+			return DrawCommand{Cmd: cmd, Mode: "off"}, nil
+		}
+		if len(fields) != 4 {
+			return DrawCommand{}, fmt.Errorf("cyclecolours requires start end interval, or off")
+		}
+		params := []int{}
+		for _, token := range fields[1:] {
+			val, err := strconv.Atoi(token)
+			if err != nil {
+				return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+			}
+			params = append(params, val)
+		}
+		return DrawCommand{Cmd: cmd, Params: params}, nil
+
+	case "screenshot":
+		// screenshot filename [transparent]
+		if len(fields) != 2 && len(fields) != 3 {
+			return DrawCommand{}, fmt.Errorf("screenshot requires a filename, plus optional transparent")
+		}
+		if err := checkImageFormat(fields[1], imageSaveFormats, true); err != nil {
+			return DrawCommand{}, err
+		}
+		dc := DrawCommand{Cmd: cmd, Str: fields[1]}
+		if len(fields) == 3 {
+			if strings.ToLower(fields[2]) != "transparent" {
+				return DrawCommand{}, fmt.Errorf("unknown screenshot option %q", fields[2])
+			}
+			dc.Mode = "transparent"
+		}
+		return dc, nil
+
+	case "seed":
+		// seed n
+		if len(fields) != 2 {
+			return DrawCommand{}, fmt.Errorf("seed requires a number")
+		}
+		if _, err := strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return DrawCommand{}, fmt.Errorf("invalid seed %q", fields[1])
+		}
+		return DrawCommand{Cmd: cmd, Str: fields[1]}, nil
+
+	case "tint":
+		// tint r g b a | tint reset
+		if len(fields) == 2 && strings.ToLower(fields[1]) == "reset" {
+			return DrawCommand{Cmd: cmd, Params: []int{255, 255, 255, 255}}, nil
+		}
+		if len(fields) != 5 {
+			return DrawCommand{}, fmt.Errorf("tint requires r g b a, or reset")
+		}
+		params := []int{}
+		for _, token := range fields[1:] {
+			val, err := strconv.Atoi(token)
+			if err != nil || val < 0 || val > 255 {
+				return DrawCommand{}, fmt.Errorf("tint values must be 0-255")
+			}
+			params = append(params, val)
+		}
+		return DrawCommand{Cmd: cmd, Params: params}, nil
+
+	case "linestyle":
+		// linestyle solid|dashed|dotted
+		if len(fields) != 2 {
+			return DrawCommand{}, fmt.Errorf("linestyle requires solid, dashed or dotted")
+		}
+		style := strings.ToLower(fields[1])
+		if _, ok := lineStyles[style]; !ok {
+			return DrawCommand{}, fmt.Errorf("unknown line style %q", fields[1])
+		}
+		return DrawCommand{Cmd: cmd, Str: style}, nil
+
+	case "penmask":
+		// penmask pattern, 0-255 in decimal, 0x hex or 0b binary
+		if len(fields) != 2 {
+			return DrawCommand{}, fmt.Errorf("penmask requires an 8-bit pattern")
+		}
+		mask, err := strconv.ParseUint(fields[1], 0, 8)
+		if err != nil {
+			return DrawCommand{}, fmt.Errorf("penmask pattern must be 0-255, e.g. 0b11110000")
+		}
+		return DrawCommand{Cmd: cmd, Params: []int{int(mask)}}, nil
+
+	case "vblank":
+		// vblank on [frames] | vblank off
+		if len(fields) == 3 && strings.ToLower(fields[1]) == "on" {
+			every, err := strconv.Atoi(fields[2])
+			if err != nil || every < 1 || every > 60 {
+				return DrawCommand{}, fmt.Errorf("vblank interval must be 1-60 frames")
+			}
+			return DrawCommand{Cmd: cmd, Params: []int{every}}, nil
+		}
+		toggle, err := parseToggleCommand(cmd, fields)
+		if err != nil {
+			return DrawCommand{}, fmt.Errorf("vblank requires on [frames] or off")
+		}
+		return toggle, nil
+
+	case "trackmouse":
+		// trackmouse on ms | trackmouse off
+		if len(fields) == 3 && strings.ToLower(fields[1]) == "on" {
+			ms, err := strconv.Atoi(fields[2])
+			if err != nil || ms < 16 || ms > 10000 {
+				return DrawCommand{}, fmt.Errorf("trackmouse interval must be 16-10000 ms")
+			}
+			return DrawCommand{Cmd: cmd, Params: []int{ms}}, nil
+		}
+		if len(fields) == 2 && strings.ToLower(fields[1]) == "off" {
+			return DrawCommand{Cmd: cmd, Params: []int{0}}, nil
+		}
+		return DrawCommand{}, fmt.Errorf("trackmouse requires on ms or off")
+
+	case "scene":
+		// scene save|load|del name
+		if len(fields) != 3 {
+			return DrawCommand{}, fmt.Errorf("scene requires save, load or del and a name")
+		}
+		action := strings.ToLower(fields[1])
+		if action != "save" && action != "load" && action != "del" {
+			return DrawCommand{}, fmt.Errorf("unknown scene action %q", fields[1])
+		}
+		return DrawCommand{Cmd: cmd, Mode: action, Str: fields[2]}, nil
+
+	case "adjust":
+		// adjust flip|layer index brightness contrast
+		if len(fields) != 5 {
+			return DrawCommand{}, fmt.Errorf("adjust requires buffer type, index, brightness and contrast")
+		}
+		kind := strings.ToLower(fields[1])
+		if kind != "flip" && kind != "layer" {
+			return DrawCommand{}, fmt.Errorf("buffer type must be flip or layer")
+		}
+		params := []int{}
+		for _, token := range fields[2:] {
+			val, err := strconv.Atoi(token)
+			if err != nil {
+				return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+			}
+			params = append(params, val)
+		}
+		if params[1] < -255 || params[1] > 255 {
+			return DrawCommand{}, fmt.Errorf("brightness must be -255 to 255")
+		}
+		if params[2] < -100 || params[2] > 100 {
+			return DrawCommand{}, fmt.Errorf("contrast must be -100 to 100")
+		}
+		return DrawCommand{Cmd: cmd, Str: kind, Params: params}, nil
+
+	case "swapchain":
+		// swapchain n | swapchain next | swapchain off
+		if len(fields) != 2 {
+			return DrawCommand{}, fmt.Errorf("swapchain requires a buffer count, next or off")
+		}
+		switch strings.ToLower(fields[1]) {
+		case "next":
+			return DrawCommand{Cmd: cmd, Mode: "next"}, nil
+		case "off":
+			return DrawCommand{Cmd: cmd, Params: []int{0}}, nil
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return DrawCommand{}, fmt.Errorf("invalid parameter %q", fields[1])
+		}
+		return DrawCommand{Cmd: cmd, Params: []int{n}}, nil
+
+	case "stencil", "mirrordraw":
+		// stencil flip|layer index on | stencil off, and the same for mirrordraw
+		if len(fields) == 2 && strings.ToLower(fields[1]) == "off" {
+			return DrawCommand{Cmd: cmd, Mode: "off"}, nil
+		}
+		if len(fields) != 4 || strings.ToLower(fields[3]) != "on" {
+			return DrawCommand{}, fmt.Errorf("%s requires flip|layer index on, or off", cmd)
+		}
+		kind := strings.ToLower(fields[1])
+		if kind != "flip" && kind != "layer" {
+			return DrawCommand{}, fmt.Errorf("buffer type must be flip or layer")
+		}
+		n, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return DrawCommand{}, fmt.Errorf("invalid parameter %q", fields[2])
+		}
+		return DrawCommand{Cmd: cmd, Mode: "on", Str: kind, Params: []int{n}}, nil
+
+	case "bgcolour":
+		// bgcolour flip|layer index colour|reset
+		if len(fields) != 4 {
+			return DrawCommand{}, fmt.Errorf("bgcolour requires buffer type, index and colour")
+		}
+		kind := strings.ToLower(fields[1])
+		if kind != "flip" && kind != "layer" {
+			return DrawCommand{}, fmt.Errorf("buffer type must be flip or layer")
+		}
+		n, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return DrawCommand{}, fmt.Errorf("invalid parameter %q", fields[2])
+		}
+		colour := -1
+		if strings.ToLower(fields[3]) != "reset" {
+			colour, err = convertToken(fields[3])
+			if err != nil || colour == -1 {
+				return DrawCommand{}, fmt.Errorf("bgcolour colour must be a palette index, rN, #RRGGBB or reset")
+			}
+		}
+		return DrawCommand{Cmd: cmd, Str: kind, Params: []int{n, colour}}, nil
+
+	case "clearonflip", "trueblack", "mouseevents", "preview", "wrap", "indexed", "vflip", "gammablend",
+		"eraser":
+		return parseToggleCommand(cmd, fields)
+
+	case "drawimage":
+		// drawimage x y filename [w h]
+		if len(fields) != 4 && len(fields) != 6 {
+			return DrawCommand{}, fmt.Errorf("drawimage requires x y filename, plus optional w h")
+		}
+		params := []int{}
+		numeric := append([]string{fields[1], fields[2]}, fields[4:]...)
+		for _, token := range numeric {
+			val, err := strconv.Atoi(token)
+			if err != nil {
+				return DrawCommand{}, fmt.Errorf("invalid parameter %q", token)
+			}
+			params = append(params, val)
+		}
+		if len(params) == 4 && (params[2] <= 0 || params[3] <= 0) {
+			return DrawCommand{}, fmt.Errorf("drawimage size must be positive")
+		}
+		return DrawCommand{Cmd: cmd, Params: params, Str: fields[3]}, nil
+
+	case "texsheet":
+		// texsheet filename tileW tileH
+		if len(fields) != 4 {
+			return DrawCommand{}, fmt.Errorf("texsheet requires filename tileW tileH")
+		}
+		tileW, err := strconv.Atoi(fields[2])
+		if err != nil || tileW <= 0 {
+			return DrawCommand{}, fmt.Errorf("invalid tile width %q", fields[2])
+		}
+		tileH, err := strconv.Atoi(fields[3])
+		if err != nil || tileH <= 0 {
+			return DrawCommand{}, fmt.Errorf("invalid tile height %q", fields[3])
+		}
+		return DrawCommand{Cmd: cmd, Str: fields[1], Params: []int{tileW, tileH}}, nil
+
+	case "texmap":
+		// texmap c n | texmap c none | texmap reset
+		if len(fields) == 2 && strings.ToLower(fields[1]) == "reset" {
+			return DrawCommand{Cmd: cmd, Mode: "reset"}, nil
+		}
+		if len(fields) != 3 || len(fields[1]) != 1 {
+			return DrawCommand{}, fmt.Errorf("texmap requires a single character and a palette index or none")
+		}
+		// Pixel data is one byte per pixel, so keys must be one byte too
+		if c := fields[1][0]; c < '!' || c > '~' {
+			return DrawCommand{}, fmt.Errorf("texmap character must be printable ASCII")
+		}
+		idx := pixelTransparent
+		if strings.ToLower(fields[2]) != "none" {
+			n, err := strconv.Atoi(fields[2])
+			if err != nil || n < 0 || n >= brightBlack {
+				return DrawCommand{}, fmt.Errorf("invalid palette index %q", fields[2])
+			}
+			idx = n
+		}
+		return DrawCommand{Cmd: cmd, Str: fields[1], Params: []int{idx}}, nil
+
+	case "loadpalette", "savepalette":
+		// loadpalette|savepalette filename
+		if len(fields) != 2 {
+			return DrawCommand{}, fmt.Errorf("%s requires a filename", cmd)
+		}
+		return DrawCommand{Cmd: cmd, Str: fields[1]}, nil
+
 	default:
 		return DrawCommand{}, fmt.Errorf("unknown command %q", cmd)
 	}
 }
 
+// parseToggleCommand parses "cmd on|off" into a single 1/0 parameter
+func parseToggleCommand(cmd string, fields []string) (DrawCommand, error) {
+	if len(fields) == 2 {
+		switch strings.ToLower(fields[1]) {
+		case "on", "1":
+			return DrawCommand{Cmd: cmd, Params: []int{1}}, nil
+		case "off", "0":
+			return DrawCommand{Cmd: cmd, Params: []int{0}}, nil
+		}
+	}
+	return DrawCommand{}, fmt.Errorf("%s requires on or off", cmd)
+}
+
+// shapeModeAliases maps long-form shape mode tokens to their letters
+var shapeModeAliases = map[string]string{
+	"FILL":   "F",
+	"STROKE": "S",
+}
+
 func parseShapeCommand(cmd string, fields []string) (DrawCommand, error) {
 	params := []int{}
 	tokenCount := len(fields) - 1
@@ -186,17 +1145,20 @@ func parseShapeCommand(cmd string, fields []string) (DrawCommand, error) {
 
 	if tokenCount > 0 {
 		lastToken := strings.ToUpper(fields[len(fields)-1])
+		if alias, ok := shapeModeAliases[lastToken]; ok {
+			lastToken = alias
+		}
 		if lastToken == "S" || lastToken == "F" || lastToken == "T" {
 			mode = lastToken
 			tokenCount--
-		} else if _, err := strconv.Atoi(fields[len(fields)-1]); err != nil {
-			return DrawCommand{}, fmt.Errorf("%s mode must be S, F, or T", cmd)
+		} else if _, err := convertToken(fields[len(fields)-1]); err != nil {
+			return DrawCommand{}, fmt.Errorf("%s mode must be S, F, or T (or stroke, fill)", cmd)
 		}
 	}
 
 	// Convert numeric parameters
 	for i := 1; i <= tokenCount; i++ {
-		val, err := strconv.Atoi(fields[i])
+		val, err := convertToken(fields[i])
 		if err != nil {
 			return DrawCommand{}, fmt.Errorf("invalid parameter %q", fields[i])
 		}
@@ -206,10 +1168,14 @@ func parseShapeCommand(cmd string, fields []string) (DrawCommand, error) {
 	// Validate parameter counts and add default color if needed
 	switch cmd {
 	case "rect":
+		// rect x y w h [colour] [rotation]
 		if len(params) == 4 {
 			params = append(params, -1)
-		} else if len(params) != 5 {
-			return DrawCommand{}, fmt.Errorf("rect requires 4 or 5 numeric parameters, plus optional mode")
+		} else if len(params) != 5 && len(params) != 6 {
+			return DrawCommand{}, fmt.Errorf("rect requires 4 to 6 numeric parameters, plus optional mode")
+		}
+		if len(params) == 6 && mode == "T" {
+			return DrawCommand{}, fmt.Errorf("rect cannot capture a rotated region")
 		}
 	case "circle":
 		if len(params) == 3 {
@@ -218,10 +1184,99 @@ func parseShapeCommand(cmd string, fields []string) (DrawCommand, error) {
 			return DrawCommand{}, fmt.Errorf("circle requires 3 or 4 numeric parameters, plus optional mode")
 		}
 	case "triangle":
+		// triangle x1 y1 x2 y2 x3 y3 [colour] [rotation]
 		if len(params) == 6 {
 			params = append(params, -1)
-		} else if len(params) != 7 {
-			return DrawCommand{}, fmt.Errorf("triangle requires 6 or 7 numeric parameters, plus optional mode")
+		} else if len(params) != 7 && len(params) != 8 {
+			return DrawCommand{}, fmt.Errorf("triangle requires 6 to 8 numeric parameters, plus optional mode")
+		}
+	case "ngon":
+		// ngon x y radius sides [rotation] [colour]
+		switch len(params) {
+		case 4:
+			params = append(params, 0, -1)
+		case 5:
+			params = append(params, -1)
+		case 6:
+		default:
+			return DrawCommand{}, fmt.Errorf("ngon requires 4 to 6 numeric parameters, plus optional mode")
+		}
+		if params[2] <= 0 {
+			return DrawCommand{}, fmt.Errorf("ngon radius must be positive")
+		}
+		if params[3] < 3 {
+			return DrawCommand{}, fmt.Errorf("ngon requires at least 3 sides")
+		}
+	case "star":
+		// star x y outerR innerR points [rotation] [colour]
+		switch len(params) {
+		case 5:
+			params = append(params, 0, -1)
+		case 6:
+			params = append(params, -1)
+		case 7:
+		default:
+			return DrawCommand{}, fmt.Errorf("star requires 5 to 7 numeric parameters, plus optional mode")
+		}
+		if params[2] <= 0 || params[3] <= 0 {
+			return DrawCommand{}, fmt.Errorf("star radii must be positive")
+		}
+		if params[4] < 3 {
+			return DrawCommand{}, fmt.Errorf("star requires at least 3 points")
+		}
+	case "ring":
+		// ring x y outerR innerR [colour]
+		if len(params) == 4 {
+			params = append(params, -1)
+		} else if len(params) != 5 {
+			return DrawCommand{}, fmt.Errorf("ring requires 4 or 5 numeric parameters, plus optional mode")
+		}
+		if params[3] < 0 || params[2] <= params[3] {
+			return DrawCommand{}, fmt.Errorf("ring outer radius must be greater than inner radius")
+		}
+	case "ellipse":
+		// ellipse cx cy rx ry [colour]
+		if len(params) == 4 {
+			params = append(params, -1)
+		} else if len(params) != 5 {
+			return DrawCommand{}, fmt.Errorf("ellipse requires 4 or 5 numeric parameters, plus optional mode")
+		}
+		if params[2] <= 0 || params[3] <= 0 {
+			return DrawCommand{}, fmt.Errorf("ellipse radii must be positive")
+		}
+		if mode == "T" {
+			return DrawCommand{}, fmt.Errorf("ellipse mode must be S or F")
+		}
+	case "oval":
+		// oval x1 y1 x2 y2 [colour]
+		if len(params) == 4 {
+			params = append(params, -1)
+		} else if len(params) != 5 {
+			return DrawCommand{}, fmt.Errorf("oval requires 4 or 5 numeric parameters, plus optional mode")
+		}
+		if params[2] <= params[0] || params[3] <= params[1] {
+			return DrawCommand{}, fmt.Errorf("oval corners must have x2 > x1 and y2 > y1")
+		}
+		if mode == "T" {
+			return DrawCommand{}, fmt.Errorf("oval mode must be S or F")
+		}
+	case "roundrect4":
+		// roundrect4 x y w h rTL rTR rBR rBL [colour]
+		if len(params) == 8 {
+			params = append(params, -1)
+		} else if len(params) != 9 {
+			return DrawCommand{}, fmt.Errorf("roundrect4 requires 8 or 9 numeric parameters, plus optional mode")
+		}
+		if params[2] <= 0 || params[3] <= 0 {
+			return DrawCommand{}, fmt.Errorf("roundrect4 width and height must be positive")
+		}
+		for _, r := range params[4:8] {
+			if r < 0 || 2*r > min(params[2], params[3]) {
+				return DrawCommand{}, fmt.Errorf("roundrect4 radii must be 0 to half the shorter side")
+			}
+		}
+		if mode == "T" {
+			return DrawCommand{}, fmt.Errorf("roundrect4 mode must be S or F")
 		}
 	}
 
@@ -233,8 +1288,8 @@ func parseShapeCommand(cmd string, fields []string) (DrawCommand, error) {
 }
 
 // processQuery handles query commands
-func processQuery(cmd string) string {
-	switch cmd {
+func processQuery(cmd DrawCommand) string {
+	switch cmd.Cmd {
 	case "colour":
 		return fmt.Sprintf("%d %d %d", defaultInk, defaultPaper, boolToInt(defaultBright))
 	case "ink":
@@ -243,18 +1298,251 @@ func processQuery(cmd string) string {
 		return fmt.Sprintf("%d", defaultPaper)
 	case "bright":
 		return fmt.Sprintf("%d", boolToInt(defaultBright))
+	case "effective":
+		return fmt.Sprintf("%d %d", effectiveInkColor(), effectivePaperColor())
 	case "paint":
 		return currentDrawingMode
+	case "macro":
+		if strings.ToLower(cmd.Str) != "list" {
+			return "ERROR 0020 : macro query must be macro list ?"
+		}
+		return macroList()
+	case "pos":
+		return fmt.Sprintf("%d %d", currentX, currentY)
+	case "lasterror":
+		// Without its ERROR prefix, so the reply is not taken for an error
+		if c, ok := cmd.Conn.(*errorLimitConn); ok {
+			if last := c.takeLastError(); last != "" {
+				return last
+			}
+		}
+		return "none"
+	case "commands":
+		return commandList()
+	case "state":
+		flip, layer, offscreenFlip, offscreenLayer := buffers.TargetState()
+		return fmt.Sprintf("%s %d %d %d %s %s %s", currentDrawingMode, buffers.ActiveTarget(),
+			flip, layer, onOff(offscreenFlip), onOff(offscreenLayer), onOff(eraserMode))
 	case "host":
-		return "zxvdu v1.0"
+		return "zxvdu v" + serverVersion
+	case "caps":
+		flip, _ := buffers.GetDisplayBuffers()
+		return fmt.Sprintf("version=%s commit=%s raylib=%s gl=%s width=%d height=%d buffers=%d textures=%d palette=%d",
+			serverVersion, gitCommit, raylibVersion(), glVersionName(rl.GetVersion()),
+			flip.Texture.Width, flip.Texture.Height, len(buffers.flipBuffers), len(textures), len(namedPalette()))
+	case "formats":
+		return "load=" + strings.Join(imageLoadFormats, ",") + " save=" + strings.Join(imageSaveFormats, ",")
+	case "outdir":
+		return outputDir
+	case "clients":
+		draw, events := clientCounts()
+		return fmt.Sprintf("%d %d", draw, events)
+	case "perf":
+		return fmt.Sprintf("%d %.2f %d", rl.GetFPS(), averageFrameTime()*1000, len(commandChan))
+	case "stat":
+		return fmt.Sprintf("queue=%d textures=%d mode=%s target=%d fps=%d",
+			len(commandChan), texturesInUse(), currentDrawingMode, buffers.ActiveTarget(), rl.GetFPS())
+	case "origin":
+		if cmd.State == nil {
+			return "0 0"
+		}
+		return fmt.Sprintf("%d %d", cmd.State.originX, cmd.State.originY)
+	case "timers":
+		return timerList()
+	case "refresh":
+		return fmt.Sprintf("%d", rl.GetMonitorRefreshRate(rl.GetCurrentMonitor()))
+	case "focus":
+		return fmt.Sprintf("%d", boolToInt(rl.IsWindowFocused()))
+	case "clearonflip":
+		return onOff(clearOnFlip)
+	case "trueblack":
+		return onOff(trueBlack)
+	case "mouseevents":
+		return onOff(mouseEvents)
+	case "preview":
+		return onOff(previewMode)
+	case "wrap":
+		return onOff(wrapMode)
+	case "vflip":
+		return onOff(vflip)
+	case "gammablend":
+		return onOff(gammaBlend)
+	case "eraser":
+		return onOff(eraserMode)
+	case "indexed":
+		return onOff(indexed != nil)
+	case "seed":
+		return fmt.Sprintf("%d", rngSeed)
+	case "tint":
+		return fmt.Sprintf("%d %d %d %d", flipTint.R, flipTint.G, flipTint.B, flipTint.A)
+	case "linestyle":
+		return lineStyle
+	case "pause":
+		return onOff(renderPaused)
+	case "stage":
+		return onOff(buffers.Staging())
+	case "target":
+		kind := "flip"
+		if targetsLayer(cmd) {
+			kind = "layer"
+		}
+		where := fmt.Sprintf("%s %d", kind, buffers.ActiveTarget())
+		switch {
+		case previewMode:
+			where += " preview"
+		case cmd.State != nil && cmd.State.frame != nil:
+			where += " frame"
+		case buffers.Staging():
+			where += " stage"
+		}
+		return where
+	case "swapchain":
+		if n := buffers.SwapChain(); n > 0 {
+			return fmt.Sprintf("%d", n)
+		}
+		return "off"
+	case "stencil":
+		if stencil == nil {
+			return "off"
+		}
+		return stencilSource
+	case "mirrordraw":
+		if mirrorKind == "" {
+			return "off"
+		}
+		return fmt.Sprintf("%s %d", mirrorKind, mirrorIndex)
+	case "penmask":
+		return fmt.Sprintf("0b%08b", penMask)
+	case "trackmouse":
+		if trackMouseMs == 0 {
+			return "off"
+		}
+		return fmt.Sprintf("on %d", trackMouseMs)
+	case "vblank":
+		if vblankEvery == 0 {
+			return "off"
+		}
+		return fmt.Sprintf("on %d", vblankEvery)
+	case "getpixel":
+		if len(cmd.Params) != 2 {
+			return "ERROR 0020 : getpixel requires x y"
+		}
+		flip, layer := buffers.GetTargetBuffers()
+		source := flip
+		if targetsLayer(cmd) {
+			source = layer
+		}
+		c, err := ReadPixel(source, cmd.Params[0], cmd.Params[1])
+		if err != nil {
+			return fmt.Sprintf("ERROR 0030 : %v", err)
+		}
+		return fmt.Sprintf("%d %d %d %d", c.R, c.G, c.B, c.A)
+	case "palette":
+		switch len(cmd.Params) {
+		case 0:
+			parts := []string{fmt.Sprintf("%d", len(namedPalette()))}
+			for _, c := range namedPalette() {
+				parts = append(parts, fmt.Sprintf("%d %d %d", c.R, c.G, c.B))
+			}
+			return strings.Join(parts, " ")
+		case 1:
+			idx := cmd.Params[0]
+			if idx < 0 || idx >= brightBlack {
+				return fmt.Sprintf("ERROR 0020 : palette index must be 0-%d", brightBlack-1)
+			}
+			c := palette[idx]
+			return fmt.Sprintf("%d %d %d", c.R, c.G, c.B)
+		default:
+			return "ERROR 0020 : palette query takes at most one index"
+		}
+	case "dumpregion":
+		fields := strings.Fields(strings.ToLower(cmd.Str))
+		if len(fields) != 6 || len(cmd.Params) != 5 || (fields[0] != "flip" && fields[0] != "layer") {
+			return "ERROR 0020 : dumpregion requires flip|layer index x y w h"
+		}
+		p := cmd.Params
+		data, err := dumpRegion(buffers, fields[0], p[0], p[1], p[2], p[3], p[4])
+		if err != nil {
+			return fmt.Sprintf("ERROR 0030 : %v", err)
+		}
+		return data
+	case "bgcolour":
+		fields := strings.Fields(strings.ToLower(cmd.Str))
+		if len(fields) != 2 || len(cmd.Params) != 1 || (fields[0] != "flip" && fields[0] != "layer") {
+			return "ERROR 0020 : bgcolour query requires flip|layer index"
+		}
+		setting, err := buffers.Background(fields[0], cmd.Params[0])
+		if err != nil {
+			return fmt.Sprintf("ERROR 0030 : %v", err)
+		}
+		if setting == -1 {
+			if fields[0] == "layer" {
+				return "none"
+			}
+			return "paper"
+		}
+		return fmt.Sprintf("%d", resolveColour(setting))
+	case "scene":
+		if strings.ToLower(cmd.Str) != "list" {
+			return "ERROR 0020 : scene query must be scene list ?"
+		}
+		return sceneList()
+	case "nearest":
+		if len(cmd.Params) != 3 {
+			return "ERROR 0020 : nearest requires r g b"
+		}
+		for _, v := range cmd.Params {
+			if v < 0 || v > 255 {
+				return "ERROR 0020 : colour values must be 0-255"
+			}
+		}
+		c := rl.NewColor(uint8(cmd.Params[0]), uint8(cmd.Params[1]), uint8(cmd.Params[2]), 255)
+		return fmt.Sprintf("%d", nearestPaletteIndex(c))
 	default:
 		return "unknown query"
 	}
 }
 
+// raylibVersion returns the raylib-go module version this binary was built
+// against, from the embedded build information
+func raylibVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/gen2brain/raylib-go/raylib" {
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+// glVersionName names the OpenGL backend reported by rl.GetVersion
+func glVersionName(v int32) string {
+	switch v {
+	case rl.Opengl11:
+		return "1.1"
+	case rl.Opengl21:
+		return "2.1"
+	case rl.Opengl33:
+		return "3.3"
+	case rl.Opengl43:
+		return "4.3"
+	case rl.OpenglEs20:
+		return "es2.0"
+	}
+	return "unknown"
+}
+
 func boolToInt(b bool) int {
 	if b {
 		return 1
 	}
 	return 0
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
 }
\ No newline at end of file
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// outputDir is the directory file commands read from and write to
+var outputDir = "."
+
+// safePath resolves a client-supplied filename inside outputDir, rejecting
+// absolute paths and anything that would escape it
+func safePath(name string) (string, error) {
+	if name == "" || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("invalid filename %q", name)
+	}
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("filename %q escapes the output directory", name)
+	}
+	return filepath.Join(outputDir, clean), nil
+}
+
+// checkInputFile resolves a filename with safePath and checks it names an
+// existing regular file
+func checkInputFile(name string) (string, error) {
+	path, err := safePath(name)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot open %q: %v", name, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%q is not a regular file", name)
+	}
+	return path, nil
+}
+
+// imageLoadFormats lists the image file types drawimage and texsheet can
+// read. raylib picks a loader by extension and only has the ones enabled
+// in its config.h; these are the ones the bundled build enables.
+var imageLoadFormats = []string{"png", "bmp", "jpg", "gif", "qoi", "dds"}
+
+// imageSaveFormats lists the image file types screenshot writes
+var imageSaveFormats = []string{"png"}
+
+// checkImageFormat checks a filename's extension is one of formats. A
+// name without an extension is allowed when optional is set.
+func checkImageFormat(name string, formats []string, optional bool) error {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if ext == "" && optional {
+		return nil
+	}
+	for _, f := range formats {
+		if ext == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported image format %q (formats ? lists them)", ext)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// FrameBatch collects one connection's drawing between beginframe and
+// endframe, so the whole frame reaches the buffer in one step and a
+// half-drawn frame is never shown
+type FrameBatch struct {
+	scratch rl.RenderTexture2D
+	layer   bool // Batch is applied to the layer buffer rather than flip
+	cleared bool // cls was used; the target is cleared before applying
+}
+
+// beginFrame starts batching a connection's drawing into a scratch buffer
+func beginFrame(bs *BufferSystem, state *connState, layer bool) error {
+	if state == nil {
+		return fmt.Errorf("beginframe needs a connection")
+	}
+	if state.frame != nil {
+		return fmt.Errorf("frame already begun")
+	}
+	flip, _ := bs.GetTargetBuffers()
+	f := &FrameBatch{
+		scratch: rl.LoadRenderTexture(flip.Texture.Width, flip.Texture.Height),
+		layer:   layer,
+	}
+	rl.BeginTextureMode(f.scratch)
+	rl.ClearBackground(rl.Color{R: 0, G: 0, B: 0, A: 0})
+	rl.EndTextureMode()
+	state.frame = f
+	return nil
+}
+
+// clear handles cls inside a frame: the batch so far is dropped and
+// the target will be cleared when the frame is applied
+func (f *FrameBatch) clear() {
+	rl.BeginTextureMode(f.scratch)
+	rl.ClearBackground(rl.Color{R: 0, G: 0, B: 0, A: 0})
+	rl.EndTextureMode()
+	f.cleared = true
+}
+
+// endFrame applies a connection's batched drawing to its target buffer
+func endFrame(bs *BufferSystem, state *connState) error {
+	if state == nil || state.frame == nil {
+		return fmt.Errorf("no frame begun")
+	}
+	f := state.frame
+	state.frame = nil
+
+	if f.cleared {
+		if f.layer {
+			bs.ClearLayer()
+		} else {
+			bs.ClearFlip()
+		}
+	}
+	flip, layer := bs.GetTargetBuffers()
+	target := flip
+	if f.layer {
+		target = layer
+	}
+
+	// The scratch buffer is stored upside down like the others, so draw
+	// it flipped to keep the same orientation
+	w, h := float32(f.scratch.Texture.Width), float32(f.scratch.Texture.Height)
+	rl.BeginTextureMode(*target)
+	rl.DrawTexturePro(f.scratch.Texture, rl.Rectangle{Width: w, Height: -h}, rl.Rectangle{Width: w, Height: h}, rl.Vector2{}, 0, rl.White)
+	rl.EndTextureMode()
+	rl.UnloadRenderTexture(f.scratch)
+	return nil
+}
+
+// discardFrame drops an unfinished frame, e.g. when its connection closes
+func discardFrame(state *connState) {
+	if state != nil && state.frame != nil {
+		rl.UnloadRenderTexture(state.frame.scratch)
+		state.frame = nil
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// gammaBlend makes colour blending work in linear light instead of on the
+// raw sRGB values, so fades and gradients do not go muddy in the middle
+var gammaBlend bool
+
+// Lookup tables between sRGB components and linear light
+var (
+	srgbToLinear [256]float32
+	linearToSRGB [4096]uint8
+)
+
+func init() {
+	for i := range srgbToLinear {
+		c := float64(i) / 255
+		if c <= 0.04045 {
+			c /= 12.92
+		} else {
+			c = math.Pow((c+0.055)/1.055, 2.4)
+		}
+		srgbToLinear[i] = float32(c)
+	}
+	for i := range linearToSRGB {
+		l := float64(i) / float64(len(linearToSRGB)-1)
+		if l <= 0.0031308 {
+			l *= 12.92
+		} else {
+			l = 1.055*math.Pow(l, 1/2.4) - 0.055
+		}
+		linearToSRGB[i] = uint8(math.Round(l * 255))
+	}
+}
+
+// mixColours blends colours by weights summing to 1, in linear light when
+// gammablend is on. Alpha is always blended directly.
+func mixColours(colours []rl.Color, weights []float32) rl.Color {
+	var r, g, b, a float32
+	for i, c := range colours {
+		w := weights[i]
+		if gammaBlend {
+			r += w * srgbToLinear[c.R]
+			g += w * srgbToLinear[c.G]
+			b += w * srgbToLinear[c.B]
+		} else {
+			r += w * float32(c.R)
+			g += w * float32(c.G)
+			b += w * float32(c.B)
+		}
+		a += w * float32(c.A)
+	}
+	if gammaBlend {
+		return rl.Color{R: fromLinear(r), G: fromLinear(g), B: fromLinear(b), A: clampByte(a)}
+	}
+	return rl.Color{R: clampByte(r), G: clampByte(g), B: clampByte(b), A: clampByte(a)}
+}
+
+// blendColours returns the colour t of the way from a to b
+func blendColours(a, b rl.Color, t float32) rl.Color {
+	return mixColours([]rl.Color{a, b}, []float32{1 - t, t})
+}
+
+// fromLinear converts a linear light value to an sRGB component
+func fromLinear(l float32) uint8 {
+	top := len(linearToSRGB) - 1
+	return linearToSRGB[max(0, min(top, int(l*float32(top)+0.5)))]
+}
+
+// clampByte rounds v to the nearest component value
+func clampByte(v float32) uint8 {
+	return uint8(max(0, min(255, int(v+0.5))))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestColourRegisterRoundTrip(t *testing.T) {
+	defer func(regs [16]int, ink int) { colourRegisters, defaultInk = regs, ink }(colourRegisters, defaultInk)
+	defaultInk = 0
+
+	val, err := convertToken("r3")
+	if err != nil {
+		t.Fatalf("convertToken(r3): %v", err)
+	}
+	if val != colourRegisterBase-3 {
+		t.Errorf("convertToken(r3) = %d, want %d", val, colourRegisterBase-3)
+	}
+
+	// An unset register stands for the ink
+	if got, err := storedColour(val); err != nil || got != 0 {
+		t.Errorf("storedColour(unset r3) = %d, %v, want 0", got, err)
+	}
+
+	colourRegisters[3] = 5
+	if got, err := storedColour(val); err != nil || got != 5 {
+		t.Errorf("storedColour(r3) = %d, %v, want 5", got, err)
+	}
+	if got := resolveColour(val); got != 5 {
+		t.Errorf("resolveColour(r3) = %d, want 5", got)
+	}
+
+	for _, token := range []string{"r16", "r-1", "rx"} {
+		if _, err := convertToken(token); err == nil {
+			t.Errorf("convertToken(%s) succeeded, want an error", token)
+		}
+	}
+}
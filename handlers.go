@@ -5,35 +5,77 @@ import (
 	"fmt"
 )
 
-// handleCLS clears the current active buffer
+// handleCLS clears the current active buffer to its background colour
 func handleCLS() {
-	flip, layer := buffers.GetTargetBuffers()
 	if currentDrawingMode == "flip" {
-		rl.BeginTextureMode(*flip)
-		rl.ClearBackground(palette[effectivePaperColor()])
-		rl.EndTextureMode()
+		buffers.ClearFlip()
 	} else {
-		rl.BeginTextureMode(*layer)
-		rl.ClearBackground(rl.Color{R: 0, G: 0, B: 0, A: 0})
-		rl.EndTextureMode()
+		buffers.ClearLayer()
+	}
+}
+
+// checkGraphicsMult reports whether n can be used as the graphics
+// multiplier. Multipliers over -maxgraphics are refused rather than risk
+// allocating render textures too large for the GPU.
+func checkGraphicsMult(n int) error {
+	if n < 1 {
+		return fmt.Errorf("graphics multiplier must be at least 1")
+	}
+	if n > maxGraphicsMult {
+		return fmt.Errorf("graphics multiplier %d is over the limit of %d", n, maxGraphicsMult)
 	}
+	return nil
 }
 
 // handleGraphics handles the graphics resolution multiplier command
-func handleGraphics(cmd DrawCommand) {
-	if len(cmd.Params) == 1 && cmd.Params[0] >= 1 {
-		graphicsMult = cmd.Params[0]
-		
-		// Calculate new dimensions
-		internalW := BaseWidth * graphicsMult
-		internalH := BaseHeight * graphicsMult
-		
-		// Create new buffer system with updated dimensions
-		buffers = NewBufferSystem(8, int32(internalW), int32(internalH))
-		
-		// Update window size
-		rl.SetWindowSize(internalW*zoomFactor, internalH*zoomFactor)
+func handleGraphics(cmd DrawCommand) error {
+	if len(cmd.Params) != 1 {
+		err := fmt.Errorf("graphics requires a multiplier")
+		reply(cmd.Conn, "ERROR 0020 :", err)
+		return err
 	}
+	if err := checkGraphicsMult(cmd.Params[0]); err != nil {
+		reply(cmd.Conn, "ERROR 0030 :", err)
+		return err
+	}
+
+	// Calculate new dimensions
+	internalW := BaseWidth * cmd.Params[0]
+	internalH := BaseHeight * cmd.Params[0]
+	
+	// Create new buffer system with updated dimensions, keeping each
+	// buffer's background colour. If the GPU cannot manage it, carry
+	// on at the old resolution.
+	bs, err := NewBufferSystem(8, int32(internalW), int32(internalH))
+	if err != nil {
+		reply(cmd.Conn, "ERROR 0030 :", err)
+		return err
+	}
+	bs.inheritBackgrounds(buffers)
+	old := buffers
+	buffers = bs
+	graphicsMult = cmd.Params[0]
+
+	// A crossfade between the old buffers cannot finish, and nothing
+	// draws into them any more, so their memory can go
+	if crossfade != nil {
+		if crossfade.mixed.ID != 0 {
+			rl.UnloadTexture(crossfade.mixed)
+		}
+		crossfade = nil
+	}
+	old.Release()
+
+	// Indexed mode keeps an index per pixel, so start it again at the new size
+	if indexed != nil {
+		rl.UnloadTexture(indexed.tex)
+		indexed = nil
+		setIndexedMode(buffers, true)
+	}
+	
+	// Update window size
+	rl.SetWindowSize(internalW*zoomFactor, internalH*zoomFactor)
+	return nil
 }
 
 // handleZoom handles the zoom factor command
@@ -74,7 +116,7 @@ func handleTextureCapture(cmd DrawCommand) (int, error) {
 	// Get the appropriate source buffer based on current mode
 	flip, layer := buffers.GetTargetBuffers()
 	source := flip
-	if currentDrawingMode == "layer" {
+	if targetsLayer(cmd) {
 		source = layer
 	}
 
@@ -109,12 +151,15 @@ func handleTexCommand(cmd DrawCommand) (int, error) {
 		if cmd.Params[0] < 0 || cmd.Params[0] >= len(textures) || !textures[cmd.Params[0]].inUse {
 			return -1, fmt.Errorf("invalid texture number")
 		}
+		// Keep the old texture if the new one cannot be made
+		if err := checkTextureSize(cmd.Params[1], cmd.Params[2]); err != nil {
+			return -1, err
+		}
 		// Delete existing texture
-		rl.UnloadTexture(textures[cmd.Params[0]].texture)
+		freeTextureSlot(cmd.Params[0])
         // Create new texture
 		slot, err := CreateTextureFromPixelData(cmd.Str, cmd.Params[1], cmd.Params[2])
 		if err != nil {
-			textures[cmd.Params[0]] = TextureEntry{}
 			return -1, err
 		}
 		return slot, nil
@@ -126,11 +171,10 @@ func handleTexCommand(cmd DrawCommand) (int, error) {
 		if cmd.Params[0] < 0 || cmd.Params[0] >= len(textures) || !textures[cmd.Params[0]].inUse {
 			return -1, fmt.Errorf("invalid texture number")
 		}
-		rl.UnloadTexture(textures[cmd.Params[0]].texture)
-		textures[cmd.Params[0]] = TextureEntry{}
+		freeTextureSlot(cmd.Params[0])
 		return cmd.Params[0], nil
 
-	case "paint":
+	case "paint", "stampc":
 		if len(cmd.Params) < 3 {
 			return -1, fmt.Errorf("invalid texture paint parameters")
 		}
@@ -139,13 +183,19 @@ func handleTexCommand(cmd DrawCommand) (int, error) {
 		}
 		flip, layer := buffers.GetTargetBuffers()
 		target := flip
-		if currentDrawingMode == "layer" {
+		if targetsLayer(cmd) {
 			target = layer
 		}
+		// paint anchors the top-left corner at x,y; stampc the centre
+		x, y := cmd.Params[0], cmd.Params[1]
+		if cmd.Mode == "stampc" {
+			x -= textures[cmd.Params[2]].width / 2
+			y -= textures[cmd.Params[2]].height / 2
+		}
 		rl.BeginTextureMode(*target)
 		destRect := rl.Rectangle{
-			X:      float32(cmd.Params[0]),
-			Y:      float32(cmd.Params[1]),
+			X:      float32(x),
+			Y:      float32(y),
 			Width:  float32(textures[cmd.Params[2]].width),
 			Height: float32(textures[cmd.Params[2]].height),
 		}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckGraphicsMult(t *testing.T) {
+	defer func(old int) { maxGraphicsMult = old }(maxGraphicsMult)
+	maxGraphicsMult = 4
+	for _, tc := range []struct {
+		n  int
+		ok bool
+	}{
+		{1, true},
+		{4, true},
+		{5, false},
+		{100, false},
+		{0, false},
+		{-1, false},
+	} {
+		err := checkGraphicsMult(tc.n)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkGraphicsMult(%d) = %v, want ok %v", tc.n, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// indexTransparent marks a transparent pixel in the index buffer
+const indexTransparent = 255
+
+// IndexedDisplay keeps flip buffer 0 as palette indices and shows them
+// through the live palette, so palette changes recolour what is on screen
+type IndexedDisplay struct {
+	indices []byte       // Palette index per pixel, in render texture order
+	last    []rl.Color   // Flip buffer 0 as it was at the last sync
+	pixels  []rl.Color   // Indices resolved through the palette
+	tex     rl.Texture2D // Resolved image shown in place of flip buffer 0
+}
+
+// Indexed display, nil when indexed mode is off; only touched from the
+// render loop
+var indexed *IndexedDisplay
+
+// setIndexedMode turns indexed mode on or off. Turning it off stops any
+// colour cycles, which need it.
+func setIndexedMode(bs *BufferSystem, on bool) {
+	if !on {
+		if indexed != nil {
+			rl.UnloadTexture(indexed.tex)
+			indexed = nil
+		}
+		stopColourCycles()
+		return
+	}
+	if indexed != nil {
+		return
+	}
+	flip, _ := bs.GetDisplayBuffers()
+	w, h := flip.Texture.Width, flip.Texture.Height
+	img := rl.GenImageColor(int(w), int(h), rl.Blank)
+	indexed = &IndexedDisplay{
+		indices: make([]byte, w*h),
+		pixels:  make([]rl.Color, w*h),
+		tex:     rl.LoadTextureFromImage(img),
+	}
+	rl.UnloadImage(img)
+	syncIndexed(bs)
+}
+
+// syncIndexed reads back flip buffer 0 and converts the pixels that have
+// changed since the last sync to palette indices. It runs before the
+// palette is cycled, so new drawing matches the palette it was drawn with.
+func syncIndexed(bs *BufferSystem) {
+	if indexed == nil {
+		return
+	}
+	rl.DrawRenderBatchActive()
+	flip, _ := bs.GetDisplayBuffers()
+	current := ReadBufferColors(flip)
+
+	// Drawing uses few colours, so remember each one's index
+	lookup := map[rl.Color]byte{}
+	for i, c := range current {
+		if indexed.last != nil && indexed.last[i] == c {
+			continue
+		}
+		idx, ok := lookup[c]
+		if !ok {
+			idx = paletteIndexOf(c)
+			lookup[c] = idx
+		}
+		indexed.indices[i] = idx
+	}
+	indexed.last = current
+}
+
+// drawIndexed shows the index buffer through the current palette in place
+// of flip buffer 0, reporting false if indexed mode is off
+func drawIndexed(srcRect, dstRect rl.Rectangle) bool {
+	if indexed == nil {
+		return false
+	}
+	for i, idx := range indexed.indices {
+		if idx == indexTransparent {
+			indexed.pixels[i] = rl.Blank
+		} else {
+			indexed.pixels[i] = palette[idx]
+		}
+	}
+	rl.UpdateTexture(indexed.tex, indexed.pixels)
+	rl.DrawTexturePro(indexed.tex, srcRect, dstRect, rl.Vector2{}, 0, flipTint)
+	return true
+}
+
+// paletteIndexOf returns the palette index closest to a pixel, or
+// indexTransparent for a transparent one
+func paletteIndexOf(c rl.Color) byte {
+	if c.A == 0 {
+		return indexTransparent
+	}
+	return byte(nearestPaletteIndex(c))
+}
+
+// dumpRegion returns a rectangle of flip or layer buffer index as base64
+// palette indices, one byte per pixel, rows top to bottom
+func dumpRegion(bs *BufferSystem, kind string, index, x, y, w, h int) (string, error) {
+	rt, err := bs.Buffer(kind, index)
+	if err != nil {
+		return "", err
+	}
+	bw, bh := int(rt.Texture.Width), int(rt.Texture.Height)
+	if w <= 0 || h <= 0 || x < 0 || y < 0 || x+w > bw || y+h > bh {
+		return "", fmt.Errorf("region %d %d %d %d is outside the %dx%d buffer", x, y, w, h, bw, bh)
+	}
+
+	rl.DrawRenderBatchActive()
+	pixels := ReadBufferColors(rt)
+	lookup := map[rl.Color]byte{}
+	out := make([]byte, 0, w*h)
+	for py := y; py < y+h; py++ {
+		// Render textures are stored upside down
+		row := (bh - 1 - py) * bw
+		for _, c := range pixels[row+x : row+x+w] {
+			idx, ok := lookup[c]
+			if !ok {
+				idx = paletteIndexOf(c)
+				lookup[c] = idx
+			}
+			out = append(out, idx)
+		}
+	}
+	return base64.StdEncoding.EncodeToString(out), nil
+}
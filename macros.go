@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxMacroDepth bounds how deeply macros may call other macros
+const maxMacroDepth = 8
+
+// maxMacroLines bounds the lines one macro call may run in all, counting
+// those of the macros it calls, so a macro calling others several times
+// over cannot flood the render loop
+const maxMacroLines = 4096
+
+// Macro is a stored command sequence. Parameters are "$name" placeholders
+// replaced with the call's arguments before each line is parsed.
+type Macro struct {
+	params []string
+	body   []string
+}
+
+// Macros by name, shared by all connections
+var (
+	macros   = map[string]*Macro{}
+	macrosMu sync.RWMutex
+)
+
+// defineMacro stores a macro, replacing any with the same name
+func defineMacro(name string, params, body []string) {
+	macrosMu.Lock()
+	defer macrosMu.Unlock()
+	macros[name] = &Macro{params: params, body: body}
+}
+
+// deleteMacro removes a macro, reporting whether it existed
+func deleteMacro(name string) bool {
+	macrosMu.Lock()
+	defer macrosMu.Unlock()
+	if _, ok := macros[name]; !ok {
+		return false
+	}
+	delete(macros, name)
+	return true
+}
+
+// lookupMacro returns a macro by name
+func lookupMacro(name string) (*Macro, bool) {
+	macrosMu.RLock()
+	defer macrosMu.RUnlock()
+	m, ok := macros[name]
+	return m, ok
+}
+
+// expand returns the macro's lines with its parameters replaced by args
+func (m *Macro) expand(args []string) ([]string, error) {
+	if len(args) != len(m.params) {
+		return nil, fmt.Errorf("expects %d arguments, got %d", len(m.params), len(args))
+	}
+	if len(args) == 0 {
+		return m.body, nil
+	}
+	// Longer names go first so $xx is not mistaken for $x followed by x
+	order := make([]int, len(m.params))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return len(m.params[order[a]]) > len(m.params[order[b]]) })
+	pairs := make([]string, 0, 2*len(args))
+	for _, i := range order {
+		pairs = append(pairs, m.params[i], args[i])
+	}
+	r := strings.NewReplacer(pairs...)
+	lines := make([]string, len(m.body))
+	for i, line := range m.body {
+		lines[i] = r.Replace(line)
+	}
+	return lines, nil
+}
+
+// validMacroParam reports whether s is a parameter name: $ then letters,
+// digits or underscores
+func validMacroParam(s string) bool {
+	if len(s) < 2 || s[0] != '$' {
+		return false
+	}
+	for _, r := range s[1:] {
+		if !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// macroList returns the defined macro names in sorted order
+func macroList() string {
+	macrosMu.RLock()
+	defer macrosMu.RUnlock()
+	names := make([]string, 0, len(macros))
+	for name := range macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
@@ -3,9 +3,17 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
+// Build information; gitCommit is set by mk.sh with
+// -ldflags "-X main.gitCommit=..."
+var (
+	serverVersion = "1.0"
+	gitCommit     = "unknown"
+)
+
 // Base resolution constants
 const (
 	BaseWidth  = 256
@@ -19,25 +27,6 @@ var (
 	defaultBright bool = false
 )
 
-// Global palette: ZX Spectrum 15-color palette
-var palette = []rl.Color{
-	rl.Black,                      // 0: Black
-	rl.NewColor(0, 0, 205, 255),     // 1: Blue
-	rl.NewColor(205, 0, 0, 255),     // 2: Red
-	rl.NewColor(205, 0, 205, 255),   // 3: Magenta
-	rl.NewColor(0, 205, 0, 255),     // 4: Green
-	rl.NewColor(0, 205, 205, 255),   // 5: Cyan
-	rl.NewColor(205, 205, 0, 255),   // 6: Yellow
-	rl.NewColor(205, 205, 205, 255), // 7: White (normal)
-	rl.NewColor(0, 0, 255, 255),     // 8: Bright Blue
-	rl.NewColor(255, 0, 0, 255),     // 9: Bright Red
-	rl.NewColor(255, 0, 255, 255),   // 10: Bright Magenta
-	rl.NewColor(0, 255, 0, 255),     // 11: Bright Green
-	rl.NewColor(0, 255, 255, 255),   // 12: Bright Cyan
-	rl.NewColor(255, 255, 0, 255),   // 13: Bright Yellow
-	rl.NewColor(255, 255, 255, 255), // 14: Bright White
-}
-
 // Global state
 var (
 	currentX, currentY    int    = 0, 0    // For lineto commands
@@ -45,8 +34,82 @@ var (
 	buffers              *BufferSystem      // Global buffer system
 	graphicsMult         int    = 1        // Graphics resolution multiplier 
 	zoomFactor           int    = 1        // Display zoom factor
+	maxGraphicsMult      int    = 8        // Largest graphics multiplier allowed
+	clearOnFlip          bool   = false    // Clear the back buffer after each flip
+	noClear              bool   = false    // Create flip buffers transparent instead of paper
+	trueBlack            bool   = false    // Give black a bright variant
+	windowFocused        bool              // Focus state seen by the render loop
+	mouseEvents          bool   = true     // Broadcast mouse click events
+	previewMode          bool   = false    // Draw into the preview layer
+	frameCount           uint64            // Frames rendered so far
+	vblankEvery          int    = 0        // Frames between vblank events (0 = off)
+	flipTint             rl.Color = rl.White // Tint applied to flip buffer 0 in the composite
+	trackMouseMs         int    = 0        // Milliseconds between mouse position samples (0 = off)
+	nextMouseSample      float64           // Time of the next mouse position sample
+	vflip                bool   = true     // Turn the buffers upright when compositing
+	renderPaused         bool   = false    // Keep the last frame on screen instead of redrawing
 )
 
+// Frame timing samples for the perf query
+var (
+	frameTimes   [60]float32
+	frameTimeIdx int
+)
+
+// recordFrameTime stores the duration of the last frame
+func recordFrameTime() {
+	frameTimes[frameTimeIdx] = rl.GetFrameTime()
+	frameTimeIdx = (frameTimeIdx + 1) % len(frameTimes)
+}
+
+// averageFrameTime returns the mean frame time in seconds over the recorded samples
+func averageFrameTime() float32 {
+	var total float32
+	n := 0
+	for _, t := range frameTimes {
+		if t > 0 {
+			total += t
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / float32(n)
+}
+
+// mousePosition returns the mouse position in buffer pixels, allowing for
+// the zoom and for the display being upside down while vflip is off
+func mousePosition() (int, int) {
+	pos := rl.GetMousePosition()
+	x, y := int(pos.X)/zoomFactor, int(pos.Y)/zoomFactor
+	if !vflip {
+		y = BaseHeight*graphicsMult - 1 - y
+	}
+	return x, y
+}
+
+// setWindowIcon loads an image file and makes it the window icon
+func setWindowIcon(path string) error {
+	if err := checkImageFormat(path, imageLoadFormats, false); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err != nil {
+		return err
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("%q is not a regular file", path)
+	}
+	img := rl.LoadImage(path)
+	if !rl.IsImageValid(img) {
+		return fmt.Errorf("cannot load image %s", path)
+	}
+	defer rl.UnloadImage(img)
+	// Window icons must be 32-bit RGBA
+	rl.ImageFormat(img, rl.UncompressedR8g8b8a8)
+	rl.SetWindowIcon(*img)
+	return nil
+}
+
 func main() {
 	// Parse command-line flags
 	inkFlag := flag.Int("ink", 0, "Default ink (foreground) color (0–7)")
@@ -57,6 +120,17 @@ func main() {
 	eventPortFlag := flag.String("eventport", "55551", "Port for event server")
 	graphicsFlag := flag.Int("graphics", 1, "Graphics resolution multiplier")
 	zoomFlag := flag.Int("zoom", 1, "Display zoom factor")
+	maxGraphicsFlag := flag.Int("maxgraphics", 8, "Largest graphics multiplier allowed")
+	maxTexMemFlag := flag.Int("maxtexmem", 0, "Maximum texture memory in bytes (0 = unlimited)")
+	noClearFlag := flag.Bool("noclear", false, "Start flip buffers transparent instead of paper")
+	queueSizeFlag := flag.Int("queuesize", 100, "Maximum number of queued drawing commands")
+	outDirFlag := flag.String("outdir", ".", "Directory file commands read from and write to")
+	greetingFlag := flag.Bool("greeting", false, "Send a banner line to each new drawing connection")
+	accessLogFlag := flag.String("accesslog", "", "Append connections and errors to this file")
+	scriptFlag := flag.String("script", "", "Command file to run at startup")
+	iconFlag := flag.String("icon", "", "Image file to use as the window icon")
+	unixSocketFlag := flag.String("unixsocket", "", "Also accept drawing commands on this Unix domain socket")
+	errorRepeatFlag := flag.Int("errorrepeat", 3, "Identical errors sent in a row before the rest are counted (0 = send all)")
 	flag.Parse()
 
 	// Apply command line settings
@@ -69,12 +143,40 @@ func main() {
 	defaultBright = (*brightFlag == 1)
 	
 	// Apply graphics and zoom settings
-	if *graphicsFlag > 0 {
+	if *maxGraphicsFlag > 0 {
+		maxGraphicsMult = *maxGraphicsFlag
+	}
+	if err := checkGraphicsMult(*graphicsFlag); err != nil {
+		fmt.Printf("Error: -graphics: %v; using 1\n", err)
+	} else {
 		graphicsMult = *graphicsFlag
 	}
 	if *zoomFlag > 0 {
 		zoomFactor = *zoomFlag
 	}
+	if *maxTexMemFlag > 0 {
+		maxTextureBytes = *maxTexMemFlag
+	}
+	noClear = *noClearFlag
+	if *outDirFlag != "" {
+		outputDir = *outDirFlag
+	}
+	if *errorRepeatFlag >= 0 {
+		errorRepeatLimit = *errorRepeatFlag
+	}
+	sendGreeting = *greetingFlag
+	if *accessLogFlag != "" {
+		if err := openAccessLog(*accessLogFlag); err != nil {
+			fmt.Println("Error opening access log:", err)
+		}
+	}
+
+	// Size the command queue before any server goroutine uses it
+	queueSize := 100
+	if *queueSizeFlag > 0 {
+		queueSize = *queueSizeFlag
+	}
+	commandChan = make(chan DrawCommand, queueSize)
 
 	// Calculate initial dimensions
 	internalW := BaseWidth * graphicsMult
@@ -85,73 +187,143 @@ func main() {
 	// Initialize window and rendering
 	rl.InitWindow(int32(windowW), int32(windowH), "zxvdu - a simple VDU / display server")
 	rl.SetTargetFPS(60)
+	if *iconFlag != "" {
+		if err := setWindowIcon(*iconFlag); err != nil {
+			fmt.Println("Error setting window icon:", err)
+		}
+	}
 
 	// Create buffer system
-	buffers = NewBufferSystem(8, int32(internalW), int32(internalH))
+	var err error
+	buffers, err = NewBufferSystem(8, int32(internalW), int32(internalH))
+	if err != nil {
+		fmt.Println("Error creating display buffers:", err)
+		rl.CloseWindow()
+		os.Exit(1)
+	}
 
 	// Start network servers
 	go startDrawingCommandServer(fmt.Sprintf("%s:%s", *hostFlag, *cmdPortFlag))
 	go startEventServer(fmt.Sprintf("%s:%s", *hostFlag, *eventPortFlag))
+	if *unixSocketFlag != "" {
+		if err := startUnixDrawingServer(*unixSocketFlag); err != nil {
+			fmt.Println("Error starting Unix socket server:", err)
+		}
+	}
+	if *scriptFlag != "" {
+		go runScript(*scriptFlag)
+	}
+
+	windowFocused = rl.IsWindowFocused()
 
 	// Main render loop
 	for !rl.WindowShouldClose() {
+		recordFrameTime()
 		processCommands()
+		checkBufferWatches()
+		syncIndexed(buffers)
+		updateColourCycles()
 
-		rl.BeginDrawing()
-		rl.ClearBackground(rl.Black)
+		// While paused the buffers still change but the window keeps its
+		// last frame; input is polled so the window can still be closed,
+		// and events and frame counting carry on
+		if renderPaused {
+			rl.PollInputEvents()
+			rl.WaitTime(1.0 / 60)
+		} else {
+			rl.BeginDrawing()
+			rl.ClearBackground(rl.Black)
 
-		// Get the visible buffers (always buffer 0)
-		flip, layer := buffers.GetDisplayBuffers()
+			// Get the visible buffers (always buffer 0), at the size the
+			// graphics command last set
+			flip, layer := buffers.GetDisplayBuffers()
+			internalW, internalH := BaseWidth*graphicsMult, BaseHeight*graphicsMult
+			windowW, windowH := internalW*zoomFactor, internalH*zoomFactor
 
-		// Source rectangle for buffer content
-		srcRect := rl.Rectangle{
-			X: 0,
-			Y: 0,
-			Width: float32(internalW),
-			Height: -float32(internalH), // Flip vertically
-		}
+			// Source rectangle for buffer content
+			srcRect := rl.Rectangle{
+				X: 0,
+				Y: 0,
+				Width: float32(internalW),
+				Height: -float32(internalH), // Flip vertically
+			}
+			if !vflip {
+				srcRect.Height = float32(internalH)
+			}
 
-		// Destination rectangle for scaled display
-		dstRect := rl.Rectangle{
-			X: 0,
-			Y: 0,
-			Width: float32(windowW),
-			Height: float32(windowH),
-		}
+			// Destination rectangle for scaled display
+			dstRect := rl.Rectangle{
+				X: 0,
+				Y: 0,
+				Width: float32(windowW),
+				Height: float32(windowH),
+			}
 
-		// Draw flip buffer 0 (visible background)
-		rl.DrawTexturePro(
-			(*flip).Texture,
-			srcRect,
-			dstRect,
-			rl.Vector2{},
-			0,
-			rl.White,
-		)
-
-		// Draw layer buffer 0 (visible overlay)
-		rl.DrawTexturePro(
-			(*layer).Texture,
-			srcRect,
-			dstRect,
-			rl.Vector2{},
-			0,
-			rl.White,
-		)
+			// Draw flip buffer 0 (visible background), or the crossfade
+			// between two flip buffers while one is running, or its palette
+			// indices in indexed mode
+			if !drawCrossfade(buffers, srcRect, dstRect) && !drawIndexed(srcRect, dstRect) {
+				rl.DrawTexturePro(
+					(*flip).Texture,
+					srcRect,
+					dstRect,
+					rl.Vector2{},
+					0,
+					flipTint,
+				)
+			}
+
+			// Draw layer buffer 0 (visible overlay)
+			rl.DrawTexturePro(
+				(*layer).Texture,
+				srcRect,
+				dstRect,
+				rl.Vector2{},
+				0,
+				rl.White,
+			)
+
+			// Draw the preview layer over everything
+			if previewMode {
+				rl.DrawTexturePro(buffers.preview.Texture, srcRect, dstRect, rl.Vector2{}, 0, rl.White)
+			}
+			rl.EndDrawing()
+		}
 
 		// Handle mouse events
-		if rl.IsMouseButtonPressed(rl.MouseLeftButton) {
-			mousePos := rl.GetMousePosition()
-			scaledX := int(mousePos.X) / zoomFactor
-			scaledY := int(mousePos.Y) / zoomFactor
+		if mouseEvents && rl.IsMouseButtonPressed(rl.MouseLeftButton) {
+			scaledX, scaledY := mousePosition()
 			eventStr := fmt.Sprintf("mouse: %d,%d", scaledX, scaledY)
 			sendEvent(eventStr)
 		}
 
-		rl.EndDrawing()
+		// Sample the mouse position at a steady rate while trackmouse is on
+		if now := rl.GetTime(); trackMouseMs > 0 && now >= nextMouseSample {
+			nextMouseSample = now + float64(trackMouseMs)/1000
+			x, y := mousePosition()
+			sendEvent(fmt.Sprintf("mousepos: %d,%d", x, y))
+		}
+
+		// Report focus changes
+		if focused := rl.IsWindowFocused(); focused != windowFocused {
+			windowFocused = focused
+			if focused {
+				sendEvent("focus: gained")
+			} else {
+				sendEvent("focus: lost")
+			}
+		}
+
+		frameCount++
+
+		// Pace clients that wait for the display
+		if vblankEvery > 0 && frameCount%uint64(vblankEvery) == 0 {
+			sendTopicEvent("vblank", fmt.Sprintf("vblank: %d", frameCount))
+		}
 	}
 
 	// Cleanup
+	closeUnixDrawingServer()
 	buffers.Cleanup()
 	rl.CloseWindow()
 }
\ No newline at end of file
@@ -5,7 +5,12 @@ echo "Building all binaries for zxvdu..."
 
 BASENAME="zxvdu"
 BINDIR="./bin"
-SOURCES="main.go graphics.go buffers.go network.go commands.go handlers.go"
+# Build the whole package so every source file is always included
+SOURCES="."
+
+# Stamp the git commit into the binary for the caps query
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+LDFLAGS="-X main.gitCommit=$COMMIT"
 
 
 # Builds for some platforms are not yet supported 
@@ -15,20 +20,20 @@ SOURCES="main.go graphics.go buffers.go network.go commands.go handlers.go"
 # https://oldbytes.social/@haitchfive 
 
 # Build for Windows
-GOOS=windows GOARCH=amd64 go build -o $BINDIR/$BASENAME.win64.exe   $SOURCES
-GOOS=windows GOARCH=386   go build -o $BINDIR/$BASENAME.win32.exe   $SOURCES
+GOOS=windows GOARCH=amd64 go build -ldflags "$LDFLAGS" -o $BINDIR/$BASENAME.win64.exe   $SOURCES
+GOOS=windows GOARCH=386   go build -ldflags "$LDFLAGS" -o $BINDIR/$BASENAME.win32.exe   $SOURCES
 
 # Build for Linux
-#GOOS=linux   GOARCH=amd64 go build -o $BINDIR/$BASENAME.linux64     $SOURCES
-#GOOS=linux   GOARCH=386   go build -o $BINDIR/$BASENAME.linux32     $SOURCES
+#GOOS=linux   GOARCH=amd64 go build -ldflags "$LDFLAGS" -o $BINDIR/$BASENAME.linux64     $SOURCES
+#GOOS=linux   GOARCH=386   go build -ldflags "$LDFLAGS" -o $BINDIR/$BASENAME.linux32     $SOURCES
 
 # Build for macOS (modern architectures)
-GOOS=darwin  GOARCH=arm64 go build -o $BINDIR/$BASENAME.mac64.m1    $SOURCES
-#GOOS=darwin  GOARCH=amd64 go build -o $BINDIR/$BASENAME.mac64.intel $SOURCES
+GOOS=darwin  GOARCH=arm64 go build -ldflags "$LDFLAGS" -o $BINDIR/$BASENAME.mac64.m1    $SOURCES
+#GOOS=darwin  GOARCH=amd64 go build -ldflags "$LDFLAGS" -o $BINDIR/$BASENAME.mac64.intel $SOURCES
 
 # Build for Raspberry Pi
-#GOOS=linux   GOARCH=arm   GOARM=6  go build -o $BINDIR/$BASENAME.rpi.arm6   $SOURCES  # Pi 1, Pi Zero
-#GOOS=linux   GOARCH=arm   GOARM=7  go build -o $BINDIR/$BASENAME.rpi.arm7   $SOURCES  # Pi 2, Pi 3 (32-bit)
-#GOOS=linux   GOARCH=arm64          go build -o $BINDIR/$BASENAME.rpi.arm64  $SOURCES  # Pi 3, Pi 4, Pi 5 (64-bit)
+#GOOS=linux   GOARCH=arm   GOARM=6  go build -ldflags "$LDFLAGS" -o $BINDIR/$BASENAME.rpi.arm6   $SOURCES  # Pi 1, Pi Zero
+#GOOS=linux   GOARCH=arm   GOARM=7  go build -ldflags "$LDFLAGS" -o $BINDIR/$BASENAME.rpi.arm7   $SOURCES  # Pi 2, Pi 3 (32-bit)
+#GOOS=linux   GOARCH=arm64          go build -ldflags "$LDFLAGS" -o $BINDIR/$BASENAME.rpi.arm64  $SOURCES  # Pi 3, Pi 4, Pi 5 (64-bit)
 
 ls -l $BINDIR/$BASENAME*
@@ -2,21 +2,89 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
-// Command channel for passing commands from network to main loop
-var commandChan = make(chan DrawCommand, 100)
+// Command channel for passing commands from network to main loop;
+// created in main once the -queuesize flag is known
+var commandChan chan DrawCommand
+
+// eventClient is a connection on the event port. Input events go to every
+// client; other topics only reach clients that subscribed to them.
+type eventClient struct {
+	conn   net.Conn
+	topics map[string]bool // Guarded by eventConnsMu
+}
 
 // Event handling
 var (
-	eventConns   = make([]net.Conn, 0)
+	eventConns   = make([]*eventClient, 0)
 	eventConnsMu sync.Mutex
 )
 
+// Drawing command connections, tracked for the clients query
+var (
+	drawConns   = make([]net.Conn, 0)
+	drawConnsMu sync.Mutex
+)
+
+// addDrawConn registers a drawing command connection
+func addDrawConn(conn net.Conn) {
+	drawConnsMu.Lock()
+	defer drawConnsMu.Unlock()
+	drawConns = append(drawConns, conn)
+}
+
+// removeDrawConn forgets a drawing command connection once it closes
+func removeDrawConn(conn net.Conn) {
+	drawConnsMu.Lock()
+	defer drawConnsMu.Unlock()
+	for i, c := range drawConns {
+		if c == conn {
+			drawConns = append(drawConns[:i], drawConns[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeEventClient drops an event client whose connection has closed
+func removeEventClient(client *eventClient) {
+	eventConnsMu.Lock()
+	defer eventConnsMu.Unlock()
+	for i, c := range eventConns {
+		if c == client {
+			eventConns = append(eventConns[:i], eventConns[i+1:]...)
+			return
+		}
+	}
+}
+
+// clientCounts returns the number of drawing and event connections
+func clientCounts() (int, int) {
+	drawConnsMu.Lock()
+	draw := len(drawConns)
+	drawConnsMu.Unlock()
+	eventConnsMu.Lock()
+	events := len(eventConns)
+	eventConnsMu.Unlock()
+	return draw, events
+}
+
+// connState holds drawing settings private to one command connection.
+// It is only read and written by the main loop, in command order.
+type connState struct {
+	originX, originY int         // Offset added to drawing coordinates
+	frame            *FrameBatch // Drawing held back until endframe, if any
+}
+
 // startDrawingCommandServer listens on a TCP port for drawing commands
 func startDrawingCommandServer(addr string) {
 	ln, err := net.Listen("tcp", addr)
@@ -26,13 +94,48 @@ func startDrawingCommandServer(addr string) {
 	}
 	defer ln.Close()
 	fmt.Println("Drawing command server listening on", addr)
-	
+	serveDrawingCommands(ln)
+}
+
+// Unix socket listener for drawing commands, nil unless -unixsocket is given
+var unixListener net.Listener
+
+// startUnixDrawingServer listens for drawing commands on a Unix domain
+// socket as well as the TCP port. A socket file left behind by an earlier
+// run is removed first; closing the listener removes this run's.
+func startUnixDrawingServer(path string) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	unixListener = ln
+	fmt.Println("Drawing command server listening on", path)
+	go serveDrawingCommands(ln)
+	return nil
+}
+
+// closeUnixDrawingServer stops the Unix socket listener and removes its file
+func closeUnixDrawingServer() {
+	if unixListener != nil {
+		unixListener.Close()
+	}
+}
+
+// serveDrawingCommands accepts drawing connections until ln is closed
+func serveDrawingCommands(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Println("Error accepting drawing command connection:", err)
 			continue
 		}
+		logAccess(conn.RemoteAddr(), "draw", "connect")
 		go handleDrawingCommandConn(conn)
 	}
 }
@@ -53,28 +156,71 @@ func startEventServer(addr string) {
 			fmt.Println("Error accepting event connection:", err)
 			continue
 		}
+		client := &eventClient{conn: conn, topics: make(map[string]bool)}
 		eventConnsMu.Lock()
-		eventConns = append(eventConns, conn)
+		eventConns = append(eventConns, client)
 		eventConnsMu.Unlock()
 		fmt.Println("New event client connected:", conn.RemoteAddr())
+		logAccess(conn.RemoteAddr(), "event", "connect")
+		go handleEventSubscriptions(client)
+	}
+}
+
+// handleEventSubscriptions reads "subscribe <topic>" and
+// "unsubscribe <topic>" lines from an event client
+func handleEventSubscriptions(client *eventClient) {
+	scanner := bufio.NewScanner(client.conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		topic := strings.ToLower(fields[1])
+		eventConnsMu.Lock()
+		switch strings.ToLower(fields[0]) {
+		case "subscribe":
+			client.topics[topic] = true
+		case "unsubscribe":
+			delete(client.topics, topic)
+		}
+		eventConnsMu.Unlock()
 	}
+	// The client has gone; stop counting it
+	removeEventClient(client)
+	client.conn.Close()
+	logAccess(client.conn.RemoteAddr(), "event", "disconnect")
 }
 
 // sendEvent broadcasts an event string to all connected event clients
 func sendEvent(event string) {
+	broadcastEvent(event, func(*eventClient) bool { return true })
+}
+
+// sendTopicEvent sends an event only to clients subscribed to topic
+func sendTopicEvent(topic, event string) {
+	broadcastEvent(event, func(c *eventClient) bool { return c.topics[topic] })
+}
+
+// broadcastEvent sends an event to the clients selected by want, dropping
+// any connection that fails
+func broadcastEvent(event string, want func(*eventClient) bool) {
 	eventConnsMu.Lock()
 	defer eventConnsMu.Unlock()
 	
 	// Create new slice for active connections
-	activeConns := make([]net.Conn, 0, len(eventConns))
+	activeConns := make([]*eventClient, 0, len(eventConns))
 	
-	// Send to all connections, collecting active ones
-	for _, conn := range eventConns {
-		_, err := fmt.Fprintln(conn, event)
+	// Send to selected connections, collecting active ones
+	for _, client := range eventConns {
+		if !want(client) {
+			activeConns = append(activeConns, client)
+			continue
+		}
+		_, err := fmt.Fprintln(client.conn, event)
 		if err == nil {
-			activeConns = append(activeConns, conn)
+			activeConns = append(activeConns, client)
 		} else {
-			conn.Close()
+			client.conn.Close()
 		}
 	}
 	
@@ -82,10 +228,112 @@ func sendEvent(event string) {
 	eventConns = activeConns
 }
 
+// reply writes a response line to the connection a command came from,
+// if there is one
+func reply(conn net.Conn, a ...interface{}) {
+	if conn != nil {
+		fmt.Fprintln(conn, a...)
+	}
+}
+
+// sendGreeting makes new drawing connections receive a banner first
+var sendGreeting bool
+
+// greetingLine describes the server for clients configuring themselves
+func greetingLine(bs *BufferSystem) string {
+	flip, _ := bs.GetDisplayBuffers()
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return fmt.Sprintf("ZXVDU version=%s width=%d height=%d flip=%d layer=%d textures=%d",
+		serverVersion, flip.Texture.Width, flip.Texture.Height,
+		len(bs.flipBuffers), len(bs.layerBuffers), len(textures))
+}
+
+// errorRepeatLimit is how many identical errors in a row a connection is
+// sent before the rest are collapsed into a count; 0 sends them all
+var errorRepeatLimit = 3
+
+// errorLimitConn wraps a command connection so that a run of identical error
+// lines is cut short, followed by one "... (xN)" line counting the ones
+// held back. Replies are written both by the connection goroutine and the
+// main loop, so the run is tracked under a lock.
+type errorLimitConn struct {
+	net.Conn
+	mu         sync.Mutex
+	last       string // Last error line written, without its newline
+	repeats    int    // Times last has been seen in a row
+	suppressed int    // Repeats not written
+	lastError  string // Most recent error, kept for lasterror? until read
+}
+
+// Write passes lines through, holding back repeated errors over the limit.
+// Every error is also sent to event clients subscribed to "error".
+func (c *errorLimitConn) Write(b []byte) (int, error) {
+	if line := strings.TrimRight(string(b), "\r\n"); strings.HasPrefix(line, "ERROR") {
+		sendTopicEvent("error", fmt.Sprintf("error: %s %s", remoteName(c.RemoteAddr()),
+			strings.TrimSpace(strings.TrimPrefix(line, "ERROR"))))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	line := strings.TrimRight(string(b), "\r\n")
+	if strings.HasPrefix(line, "ERROR") {
+		logAccess(c.RemoteAddr(), "draw", "%s", line)
+		c.lastError = strings.TrimSpace(strings.TrimPrefix(line, "ERROR"))
+	}
+	if errorRepeatLimit > 0 && strings.HasPrefix(line, "ERROR") && line == c.last {
+		c.repeats++
+		if c.repeats > errorRepeatLimit {
+			c.suppressed++
+			return len(b), nil
+		}
+		return c.Conn.Write(b)
+	}
+
+	c.flushLocked()
+	if strings.HasPrefix(line, "ERROR") {
+		c.last, c.repeats = line, 1
+	}
+	return c.Conn.Write(b)
+}
+
+// Flush reports any errors held back and ends the current run
+func (c *errorLimitConn) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+// takeLastError returns the connection's most recent error and forgets it
+func (c *errorLimitConn) takeLastError() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last := c.lastError
+	c.lastError = ""
+	return last
+}
+
+func (c *errorLimitConn) flushLocked() {
+	if c.suppressed > 0 {
+		fmt.Fprintf(c.Conn, "%s (x%d)\n", c.last, c.suppressed)
+	}
+	c.last, c.repeats, c.suppressed = "", 0, 0
+}
+
 // handleDrawingCommandConn reads commands from a TCP connection
-func handleDrawingCommandConn(conn net.Conn) {
-	defer conn.Close()
+func handleDrawingCommandConn(rawConn net.Conn) {
+	defer logAccess(rawConn.RemoteAddr(), "draw", "disconnect")
+	defer rawConn.Close()
+	addDrawConn(rawConn)
+	defer removeDrawConn(rawConn)
+	conn := &errorLimitConn{Conn: rawConn}
+	defer conn.Flush()
+	if sendGreeting {
+		fmt.Fprintln(conn, greetingLine(buffers))
+	}
 	scanner := bufio.NewScanner(conn)
+	state := &connState{}
 	
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -94,37 +342,178 @@ func handleDrawingCommandConn(conn net.Conn) {
 			fmt.Fprintln(conn, "ERROR 0020 :", err)
 			continue
 		}
+		// A good command ends any run of errors
+		conn.Flush()
+		cmd.Conn = conn
+		cmd.State = state
 		
-		// Handle queries directly
-		if cmd.Mode == "query" {
-			response := processQuery(cmd.Cmd)
-			fmt.Fprintln(conn, response)
-			continue
+		dispatchCommand(cmd, 0, nil)
+	}
+	
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Error reading from drawing command connection:", err)
+	}
+
+	// Let the main loop free anything held for this connection
+	commandChan <- DrawCommand{Cmd: "disconnect", State: state}
+}
+
+// dispatchCommand handles a parsed command from a connection: answering it
+// at once, expanding it, or queueing it for the main loop. depth counts
+// macro nesting, and expanded the lines run so far by the outermost macro
+// call, or is nil outside one.
+func dispatchCommand(cmd DrawCommand, depth int, expanded *int) {
+	conn := cmd.Conn
+
+	// Macros are stored and expanded here, so their lines are handled
+	// exactly like lines sent by the client
+	if cmd.Cmd == "macro" {
+		runMacro(cmd, depth, expanded)
+		return
+	}
+
+	// Handle queries directly
+	if cmd.Mode == "query" && !mainThreadQueries[cmd.Cmd] {
+		response := processQuery(cmd)
+		fmt.Fprintln(conn, response)
+		return
+	}
+
+	// Handle texture operations that need immediate response
+	if isTextureOperation(cmd) {
+		handleTextureOperation(cmd, conn)
+		return
+	}
+
+	// Pixel character mapping takes effect at once, like the tex
+	// commands that read it
+	if cmd.Cmd == "texmap" {
+		if cmd.Mode == "reset" {
+			resetPixelChars()
+		} else {
+			setPixelChar([]rune(cmd.Str)[0], cmd.Params[0])
 		}
+		return
+	}
 
-		// Handle texture operations that need immediate response
-		if isTextureOperation(cmd) {
-			handleTextureOperation(cmd, conn)
-			continue
+	// Check image files exist before queueing the command
+	if cmd.Cmd == "drawimage" || cmd.Cmd == "texsheet" {
+		if err := checkImageFormat(cmd.Str, imageLoadFormats, false); err != nil {
+			fmt.Fprintln(conn, "ERROR 0040 :", err)
+			return
 		}
+		path, err := checkInputFile(cmd.Str)
+		if err != nil {
+			fmt.Fprintln(conn, "ERROR 0040 :", err)
+			return
+		}
+		cmd.Str = path
+	}
 
-		// Send other commands to main loop
-		select {
-		case commandChan <- cmd:
-			// Command sent successfully
-		default:
-			fmt.Fprintln(conn, "ERROR 0033 : server busy, try again later")
+	// Benchmarks queue their own commands
+	if cmd.Cmd == "bench" {
+		if err := queueBenchmark(cmd); err != nil {
+			fmt.Fprintln(conn, "ERROR 0020 :", err)
 		}
+		return
 	}
-	
-	if err := scanner.Err(); err != nil {
-		fmt.Println("Error reading from drawing command connection:", err)
+
+	// Read palette files here so format errors reach the client;
+	// the colours are applied by the main loop
+	if cmd.Cmd == "loadpalette" {
+		path, err := checkInputFile(cmd.Str)
+		if err != nil {
+			fmt.Fprintln(conn, "ERROR 0040 :", err)
+			return
+		}
+		colours, err := loadPaletteFile(path)
+		if err != nil {
+			fmt.Fprintln(conn, "ERROR 0040 :", err)
+			return
+		}
+		for _, c := range colours {
+			cmd.Params = append(cmd.Params, int(c.R), int(c.G), int(c.B))
+		}
+	}
+
+	// Send other commands to main loop
+	select {
+	case commandChan <- cmd:
+		// Command sent successfully
+	default:
+		fmt.Fprintln(conn, "ERROR 0033 : server busy, try again later")
+	}
+}
+
+// runMacro handles macro definitions and expands macro calls, dispatching
+// each line as if the connection had sent it
+func runMacro(cmd DrawCommand, depth int, expanded *int) {
+	switch cmd.Mode {
+	case "define":
+		defineMacro(cmd.Str, cmd.Args, cmd.Body)
+	case "del":
+		if !deleteMacro(cmd.Str) {
+			reply(cmd.Conn, "ERROR 0035 : no macro named", cmd.Str)
+		}
+	case "call":
+		m, ok := lookupMacro(cmd.Str)
+		if !ok {
+			reply(cmd.Conn, "ERROR 0035 : no macro named", cmd.Str)
+			return
+		}
+		if depth >= maxMacroDepth {
+			reply(cmd.Conn, "ERROR 0035 : macros nested too deeply in", cmd.Str)
+			return
+		}
+		lines, err := m.expand(cmd.Args)
+		if err != nil {
+			reply(cmd.Conn, "ERROR 0035 : macro", cmd.Str, err)
+			return
+		}
+		if expanded == nil {
+			expanded = new(int)
+		}
+		for _, line := range lines {
+			// Report the limit once; the calls it stops end quietly
+			if *expanded >= maxMacroLines {
+				if *expanded == maxMacroLines {
+					reply(cmd.Conn, "ERROR 0035 : macro", cmd.Str, "runs more than", maxMacroLines, "lines")
+					*expanded++
+				}
+				return
+			}
+			*expanded++
+			inner, err := parseCommand(line)
+			if err != nil {
+				reply(cmd.Conn, "ERROR 0020 :", err)
+				continue
+			}
+			inner.Conn = cmd.Conn
+			inner.State = cmd.State
+			dispatchCommand(inner, depth+1, expanded)
+		}
+	}
+}
+
+// queueBenchmark queues count no-op draws followed by a sentinel that
+// reports the elapsed time once the render loop reaches it. Sends block
+// rather than failing when the queue is full, so backpressure is measured.
+func queueBenchmark(cmd DrawCommand) error {
+	if len(cmd.Params) != 1 || cmd.Params[0] < 1 || cmd.Params[0] > 100000 {
+		return fmt.Errorf("bench requires a count from 1 to 100000")
 	}
+	start := time.Now()
+	for i := 0; i < cmd.Params[0]; i++ {
+		commandChan <- DrawCommand{Cmd: "nop"}
+	}
+	commandChan <- DrawCommand{Cmd: "benchdone", Params: cmd.Params, Conn: cmd.Conn, Queued: start}
+	return nil
 }
 
-// isTextureOperation checks if a command needs immediate texture handling
+// isTextureOperation checks if a command needs immediate texture handling.
+// tex grabscreen renders, so it is queued for the main loop instead.
 func isTextureOperation(cmd DrawCommand) bool {
-	return cmd.Cmd == "tex" || (cmd.Cmd == "rect" && strings.EqualFold(cmd.Mode, "T"))
+	return (cmd.Cmd == "tex" && cmd.Mode != "grabscreen") || (cmd.Cmd == "rect" && strings.EqualFold(cmd.Mode, "T"))
 }
 
 // handleTextureOperation processes texture-related commands and sends responses
@@ -142,6 +531,7 @@ func handleTextureOperation(cmd DrawCommand, conn net.Conn) {
 		switch err.Error() {
 		case "no free texture slots":
 			fmt.Fprintln(conn, "ERROR 0031 : no free texture slots available")
+			sendTopicEvent("tex", "tex: full")
 		case "invalid region bounds":
 			fmt.Fprintln(conn, "ERROR 0030 : invalid capture region")
 		case "no pixel data provided":
@@ -150,6 +540,8 @@ func handleTextureOperation(cmd DrawCommand, conn net.Conn) {
 			fmt.Fprintln(conn, "ERROR 0022 : invalid texture number")
 		case "invalid texture parameters":
 			fmt.Fprintln(conn, "ERROR 0023 : invalid texture parameters")
+		case "texture memory limit exceeded":
+			fmt.Fprintln(conn, "ERROR 0024 : texture memory limit exceeded")
 		default:
 			fmt.Fprintln(conn, "ERROR 0029 : texture operation failed:", err)
 		}
@@ -158,6 +550,10 @@ func handleTextureOperation(cmd DrawCommand, conn net.Conn) {
 
 	// Send successful texture slot number
 	fmt.Fprintln(conn, slot)
+
+	if cmd.Cmd == "tex" && cmd.Mode == "del" {
+		sendTopicEvent("tex", fmt.Sprintf("tex: freed %d", slot))
+	}
 }
 
 // processCommands consumes commands from the command channel
@@ -181,15 +577,36 @@ func processCommands() {
 
 // executeCommand processes a single drawing command
 func executeCommand(cmd DrawCommand) (int, error) {
+	// Queries that need the main thread are answered here
+	if cmd.Mode == "query" {
+		reply(cmd.Conn, processQuery(cmd))
+		return -1, nil
+	}
+
+	if cmd.Colours != nil {
+		restore, err := cmd.Colours.apply()
+		if err != nil {
+			reply(cmd.Conn, "ERROR 0020 :", err)
+			return -1, fmt.Errorf("colour error: %v", err)
+		}
+		defer restore()
+	}
+
 	switch cmd.Cmd {
 	case "cls":
-		if currentDrawingMode == "layer" {
+		if cmd.State != nil && cmd.State.frame != nil {
+			cmd.State.frame.clear()
+		} else if targetsLayer(cmd) {
 			buffers.ClearLayer()
 		} else {
 			buffers.ClearFlip()
 		}
 		
 	case "flip":
+		if cmd.Mode == "next" || cmd.Mode == "prev" {
+			buffers.RotateFlip(pageStep(cmd.Mode))
+			break
+		}
 		n := 1 // default
 		if len(cmd.Params) > 0 {
 			n = cmd.Params[0]
@@ -197,8 +614,16 @@ func executeCommand(cmd DrawCommand) (int, error) {
 		if err := buffers.SwapFlip(n); err != nil {
 			return -1, fmt.Errorf("flip error: %v", err)
 		}
+		// The old front buffer is now at n; give it a fresh page
+		if clearOnFlip {
+			buffers.ClearFlipIndex(n)
+		}
 		
 	case "layer":
+		if cmd.Mode == "next" || cmd.Mode == "prev" {
+			buffers.RotateLayer(pageStep(cmd.Mode))
+			break
+		}
 		n := 1 // default
 		if len(cmd.Params) > 0 {
 			n = cmd.Params[0]
@@ -222,14 +647,18 @@ func executeCommand(cmd DrawCommand) (int, error) {
 			}
 		}
 		
-	case "ink":
-		if len(cmd.Params) == 1 {
-			defaultInk = cmd.Params[0]
-		}
-		
-	case "paper":
+	case "ink", "paper":
 		if len(cmd.Params) == 1 {
-			defaultPaper = cmd.Params[0]
+			c, err := storedColour(cmd.Params[0])
+			if err != nil {
+				reply(cmd.Conn, "ERROR 0020 :", err)
+				return -1, fmt.Errorf("%s error: %v", cmd.Cmd, err)
+			}
+			if cmd.Cmd == "ink" {
+				defaultInk = c
+			} else {
+				defaultPaper = c
+			}
 		}
 		
 	case "bright":
@@ -239,14 +668,308 @@ func executeCommand(cmd DrawCommand) (int, error) {
 		
 	case "colour":
 		if len(cmd.Params) == 3 {
-			defaultInk = cmd.Params[0]
-			defaultPaper = cmd.Params[1]
+			ink, err := storedColour(cmd.Params[0])
+			paper, perr := storedColour(cmd.Params[1])
+			if err == nil {
+				err = perr
+			}
+			if err != nil {
+				reply(cmd.Conn, "ERROR 0020 :", err)
+				return -1, fmt.Errorf("colour error: %v", err)
+			}
+			defaultInk, defaultPaper = ink, paper
 			defaultBright = (cmd.Params[2] == 1)
 		}
 		
+	case "origin":
+		if len(cmd.Params) == 2 && cmd.State != nil {
+			cmd.State.originX, cmd.State.originY = cmd.Params[0], cmd.Params[1]
+		}
+		
+	case "texsheet":
+		slots, err := CreateTexturesFromSheet(cmd.Str, cmd.Params[0], cmd.Params[1])
+		if err != nil {
+			switch err.Error() {
+			case "no free texture slots":
+				reply(cmd.Conn, "ERROR 0031 : not enough free texture slots for sheet")
+				sendTopicEvent("tex", "tex: full")
+			case "texture memory limit exceeded":
+				reply(cmd.Conn, "ERROR 0024 : texture memory limit exceeded")
+			default:
+				reply(cmd.Conn, "ERROR 0029 : texture operation failed:", err)
+			}
+			return -1, err
+		}
+		list := make([]string, len(slots))
+		for i, slot := range slots {
+			list[i] = fmt.Sprint(slot)
+		}
+		reply(cmd.Conn, strings.Join(list, " "))
+		
+	case "tex":
+		// Only tex grabscreen is queued; the other tex commands are
+		// answered when they arrive
+		slot, err := GrabScreen(buffers)
+		if err != nil {
+			switch err.Error() {
+			case "no free texture slots":
+				reply(cmd.Conn, "ERROR 0031 : no free texture slots available")
+				sendTopicEvent("tex", "tex: full")
+			case "texture memory limit exceeded":
+				reply(cmd.Conn, "ERROR 0024 : texture memory limit exceeded")
+			default:
+				reply(cmd.Conn, "ERROR 0029 : texture operation failed:", err)
+			}
+			return -1, err
+		}
+		reply(cmd.Conn, slot)
+		return slot, nil
+		
+	case "sync":
+		// Everything queued before this has now been drawn
+		reply(cmd.Conn, "SYNCED")
+		
+	case "echo":
+		reply(cmd.Conn, cmd.Str)
+		
+	case "benchdone":
+		elapsed := time.Since(cmd.Queued)
+		reply(cmd.Conn, fmt.Sprintf("%d %.3f", cmd.Params[0], float64(elapsed.Microseconds())/1000))
+		
+	case "clearonflip":
+		clearOnFlip = cmd.Params[0] == 1
+		
+	case "trueblack":
+		trueBlack = cmd.Params[0] == 1
+		
+	case "mouseevents":
+		mouseEvents = cmd.Params[0] == 1
+		
+	case "indexed":
+		setIndexedMode(buffers, cmd.Params[0] == 1)
+		
+	case "wrap":
+		wrapMode = cmd.Params[0] == 1
+		
+	case "vflip":
+		vflip = cmd.Params[0] == 1
+		
+	case "gammablend":
+		gammaBlend = cmd.Params[0] == 1
+		
+	case "eraser":
+		// Flip buffers have nothing to show through, so say so rather
+		// than quietly drawing as usual
+		if cmd.Params[0] == 1 && !targetsLayer(cmd) {
+			reply(cmd.Conn, "ERROR 0030 : eraser only works in layer mode; use paint layer first")
+			return -1, fmt.Errorf("eraser error: not in layer mode")
+		}
+		eraserMode = cmd.Params[0] == 1
+		
+	case "preview":
+		previewMode = cmd.Params[0] == 1
+		if !previewMode {
+			buffers.ClearPreview()
+		}
+		
+	case "watchbuffer":
+		if err := setBufferWatch(cmd.Str, cmd.Params[0], cmd.Params[1]); err != nil {
+			return -1, fmt.Errorf("watchbuffer error: %v", err)
+		}
+		
+	case "setcol":
+		var err error
+		switch {
+		case len(cmd.Params) != 2:
+			err = fmt.Errorf("setcol requires register and palette index")
+		case cmd.Params[0] < 0 || cmd.Params[0] >= len(colourRegisters):
+			err = fmt.Errorf("setcol: invalid register %d", cmd.Params[0])
+		default:
+			cmd.Params[1] = literalColour(cmd.Params[1])
+			if cmd.Params[1] < -1 || cmd.Params[1] >= brightBlack {
+				err = fmt.Errorf("setcol: invalid palette index %d", cmd.Params[1])
+			}
+		}
+		if err != nil {
+			reply(cmd.Conn, "ERROR 0020 :", err)
+			return -1, err
+		}
+		colourRegisters[cmd.Params[0]] = cmd.Params[1]
+		
+	case "loadpalette":
+		for i := 0; i+2 < len(cmd.Params); i += 3 {
+			palette[i/3] = rl.NewColor(uint8(cmd.Params[i]), uint8(cmd.Params[i+1]), uint8(cmd.Params[i+2]), 255)
+		}
+		
+	case "seed":
+		seed, err := strconv.ParseInt(cmd.Str, 10, 64)
+		if err != nil {
+			reply(cmd.Conn, "ERROR 0020 : invalid seed", cmd.Str)
+			return -1, fmt.Errorf("seed error: %v", err)
+		}
+		seedRandom(seed)
+		
+	case "moveto":
+		if len(cmd.Params) != 2 {
+			return -1, fmt.Errorf("moveto requires x y")
+		}
+		currentX, currentY = cmd.Params[0], cmd.Params[1]
+		
+	case "adjust":
+		if err := adjustBuffer(buffers, cmd.Str, cmd.Params[0], cmd.Params[1], cmd.Params[2]); err != nil {
+			reply(cmd.Conn, "ERROR 0030 :", err)
+			return -1, fmt.Errorf("adjust error: %v", err)
+		}
+		
+	case "pause":
+		renderPaused = true
+		
+	case "resume":
+		renderPaused = false
+		
+	case "graphics":
+		if err := handleGraphics(cmd); err != nil {
+			return -1, fmt.Errorf("graphics error: %v", err)
+		}
+		
+	case "stage":
+		if err := buffers.Stage(); err != nil {
+			reply(cmd.Conn, "ERROR 0030 :", err)
+			return -1, fmt.Errorf("stage error: %v", err)
+		}
+		
+	case "commit":
+		if err := buffers.Commit(); err != nil {
+			reply(cmd.Conn, "ERROR 0030 :", err)
+			return -1, fmt.Errorf("commit error: %v", err)
+		}
+		
+	case "swapchain":
+		if cmd.Mode == "next" {
+			back, err := buffers.AdvanceSwapChain()
+			if err != nil {
+				reply(cmd.Conn, "ERROR 0030 :", err)
+				return -1, fmt.Errorf("swapchain error: %v", err)
+			}
+			// The buffer that was shown is now last in line; give it a
+			// fresh page as flip does
+			if clearOnFlip {
+				buffers.ClearFlipIndex(back)
+			}
+			break
+		}
+		if err := buffers.SetSwapChain(cmd.Params[0]); err != nil {
+			reply(cmd.Conn, "ERROR 0030 :", err)
+			return -1, fmt.Errorf("swapchain error: %v", err)
+		}
+		
+	case "stencil":
+		if cmd.Mode == "off" {
+			clearStencil()
+			break
+		}
+		if err := setStencil(buffers, cmd.Str, cmd.Params[0]); err != nil {
+			reply(cmd.Conn, "ERROR 0030 :", err)
+			return -1, fmt.Errorf("stencil error: %v", err)
+		}
+		
+	case "mirrordraw":
+		if cmd.Mode == "off" {
+			mirrorKind = ""
+			break
+		}
+		if _, err := buffers.Buffer(cmd.Str, cmd.Params[0]); err != nil {
+			reply(cmd.Conn, "ERROR 0030 :", err)
+			return -1, fmt.Errorf("mirrordraw error: %v", err)
+		}
+		mirrorKind, mirrorIndex = cmd.Str, cmd.Params[0]
+		
+	case "bgcolour":
+		if err := buffers.SetBackground(cmd.Str, cmd.Params[0], cmd.Params[1]); err != nil {
+			reply(cmd.Conn, "ERROR 0030 :", err)
+			return -1, fmt.Errorf("bgcolour error: %v", err)
+		}
+		
+	case "beginframe":
+		if err := beginFrame(buffers, cmd.State, targetsLayer(cmd)); err != nil {
+			reply(cmd.Conn, "ERROR 0020 :", err)
+			return -1, fmt.Errorf("beginframe error: %v", err)
+		}
+		
+	case "endframe":
+		if err := endFrame(buffers, cmd.State); err != nil {
+			reply(cmd.Conn, "ERROR 0020 :", err)
+			return -1, fmt.Errorf("endframe error: %v", err)
+		}
+		
+	case "disconnect":
+		discardFrame(cmd.State)
+		
+	case "tint":
+		flipTint = rl.NewColor(uint8(cmd.Params[0]), uint8(cmd.Params[1]), uint8(cmd.Params[2]), uint8(cmd.Params[3]))
+		
+	case "crossfade":
+		if len(cmd.Params) != 3 {
+			return -1, fmt.Errorf("crossfade requires from, to and steps")
+		}
+		if err := startCrossfade(buffers, cmd.Params[0], cmd.Params[1], cmd.Params[2]); err != nil {
+			reply(cmd.Conn, "ERROR 0020 :", err)
+			return -1, fmt.Errorf("crossfade error: %v", err)
+		}
+		
+	case "linestyle":
+		lineStyle = cmd.Str
+		
+	case "penmask":
+		penMask = byte(cmd.Params[0])
+		
+	case "vblank":
+		vblankEvery = cmd.Params[0]
+		
+	case "trackmouse":
+		trackMouseMs = cmd.Params[0]
+		nextMouseSample = 0
+		
+	case "notify":
+		sendEvent("notify: " + cmd.Str)
+		
+	case "scene":
+		var err error
+		switch cmd.Mode {
+		case "save":
+			err = saveScene(buffers, cmd.Str)
+		case "load":
+			err = loadScene(buffers, cmd.Str)
+		case "del":
+			err = deleteScene(cmd.Str)
+		}
+		if err != nil {
+			reply(cmd.Conn, "ERROR 0034 :", err)
+			return -1, fmt.Errorf("scene error: %v", err)
+		}
+		
+	case "cyclecolours":
+		if cmd.Mode == "off" {
+			stopColourCycles()
+		} else if err := setColourCycle(cmd.Params[0], cmd.Params[1], cmd.Params[2]); err != nil {
+			reply(cmd.Conn, "ERROR 0020 :", err)
+			return -1, fmt.Errorf("cyclecolours error: %v", err)
+		}
+		
+	case "screenshot":
+		if err := saveScreenshot(buffers, cmd.Str, cmd.Mode == "transparent"); err != nil {
+			reply(cmd.Conn, "ERROR 0040 :", err)
+			return -1, fmt.Errorf("screenshot error: %v", err)
+		}
+		
+	case "savepalette":
+		if err := savePaletteFile(cmd.Str); err != nil {
+			reply(cmd.Conn, "ERROR 0040 :", err)
+		}
+		
 	default:
 		// Drawing commands
-		return updateActiveBuffer(buffers, cmd, currentDrawingMode == "layer")
+		return updateActiveBuffer(buffers, cmd, targetsLayer(cmd))
 	}
 
 	return -1, nil
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// loadPaletteFile reads a JASC-PAL file or a plain list of "r g b" lines.
+// Blank lines and lines starting with # are ignored in plain files.
+func loadPaletteFile(filename string) ([]rl.Color, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open palette file: %v", err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read palette file: %v", err)
+	}
+
+	expected := -1
+	if len(lines) > 0 && lines[0] == "JASC-PAL" {
+		// JASC-PAL header: magic, version, entry count
+		if len(lines) < 3 {
+			return nil, fmt.Errorf("truncated JASC-PAL header")
+		}
+		if lines[1] != "0100" {
+			return nil, fmt.Errorf("unsupported JASC-PAL version %q", lines[1])
+		}
+		expected, err = strconv.Atoi(lines[2])
+		if err != nil || expected < 1 {
+			return nil, fmt.Errorf("invalid JASC-PAL entry count %q", lines[2])
+		}
+		lines = lines[3:]
+	}
+
+	colours := make([]rl.Color, 0, len(lines))
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("entry %d: expected 3 values, got %d", i, len(fields))
+		}
+		var rgb [3]uint8
+		for j, field := range fields {
+			v, err := strconv.Atoi(field)
+			if err != nil || v < 0 || v > 255 {
+				return nil, fmt.Errorf("entry %d: invalid colour value %q", i, field)
+			}
+			rgb[j] = uint8(v)
+		}
+		colours = append(colours, rl.NewColor(rgb[0], rgb[1], rgb[2], 255))
+	}
+
+	if expected >= 0 && len(colours) != expected {
+		return nil, fmt.Errorf("header declares %d entries but file has %d", expected, len(colours))
+	}
+	if len(colours) == 0 {
+		return nil, fmt.Errorf("palette file has no entries")
+	}
+	if len(colours) > len(namedPalette()) {
+		return nil, fmt.Errorf("palette file has %d entries, maximum is %d", len(colours), len(namedPalette()))
+	}
+	return colours, nil
+}
+
+// savePaletteFile writes the current palette, bright variants included,
+// as a JASC-PAL file inside the output directory
+func savePaletteFile(name string) error {
+	path, err := safePath(name)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "JASC-PAL\r\n0100\r\n%d\r\n", len(namedPalette()))
+	for _, c := range namedPalette() {
+		fmt.Fprintf(&sb, "%d %d %d\r\n", c.R, c.G, c.B)
+	}
+
+	if err := os.WriteFile(path, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("cannot write palette file: %v", err)
+	}
+	return nil
+}
+
+// nearestPaletteIndex returns the index of the named palette entry closest to c
+// by Euclidean distance in RGB; ties go to the lowest index
+func nearestPaletteIndex(c rl.Color) int {
+	best, bestDist := 0, -1
+	for i, p := range namedPalette() {
+		dr := int(c.R) - int(p.R)
+		dg := int(c.G) - int(p.G)
+		db := int(c.B) - int(p.B)
+		dist := dr*dr + dg*dg + db*db
+		if bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
+
+// colourCycle rotates a range of palette entries at a fixed interval
+type colourCycle struct {
+	start, end int
+	interval   time.Duration
+	next       time.Time
+}
+
+// colourCycles are keyed by "start end"; only touched by the main loop
+var colourCycles = map[string]*colourCycle{}
+
+// setColourCycle starts, changes or (with interval 0) stops cycling the
+// palette entries start to end inclusive. Cycles only run in indexed mode,
+// where the pixels already on screen follow the palette; otherwise they
+// would only change later drawing.
+func setColourCycle(start, end, intervalMs int) error {
+	if start < 0 || end >= brightBlack || start >= end {
+		return fmt.Errorf("cycle range must be two palette indices, lowest first")
+	}
+	key := fmt.Sprintf("%d %d", start, end)
+	if intervalMs <= 0 {
+		delete(colourCycles, key)
+		return nil
+	}
+	if indexed == nil {
+		return fmt.Errorf("colour cycling needs indexed mode; use indexed on first")
+	}
+	for k, c := range colourCycles {
+		if k != key && start <= c.end && c.start <= end {
+			return fmt.Errorf("cycle range overlaps %d-%d", c.start, c.end)
+		}
+	}
+	colourCycles[key] = &colourCycle{
+		start:    start,
+		end:      end,
+		interval: time.Duration(intervalMs) * time.Millisecond,
+	}
+	return nil
+}
+
+// stopColourCycles stops every colour cycle, leaving the palette as it is
+func stopColourCycles() {
+	colourCycles = map[string]*colourCycle{}
+}
+
+// updateColourCycles moves each cycle that is due on by one entry, the
+// last colour of the range wrapping round to the first
+func updateColourCycles() {
+	now := time.Now()
+	for _, c := range colourCycles {
+		if now.Before(c.next) {
+			continue
+		}
+		c.next = now.Add(c.interval)
+		last := palette[c.end]
+		copy(palette[c.start+1:c.end+1], palette[c.start:c.end])
+		palette[c.start] = last
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+func TestNearestPaletteIndexTieTakesLowestIndex(t *testing.T) {
+	// 0,0,230 is 25 away from both blue (1) and bright blue (8)
+	if got := nearestPaletteIndex(rl.NewColor(0, 0, 230, 255)); got != 1 {
+		t.Errorf("nearestPaletteIndex(0,0,230) = %d, want 1", got)
+	}
+	// 230,0,0 is likewise between red (2) and bright red (9)
+	if got := nearestPaletteIndex(rl.NewColor(230, 0, 0, 255)); got != 2 {
+		t.Errorf("nearestPaletteIndex(230,0,0) = %d, want 2", got)
+	}
+}
+
+func TestNearestPaletteIndexExactMatch(t *testing.T) {
+	for i, c := range namedPalette() {
+		if got := nearestPaletteIndex(c); got != i {
+			t.Errorf("nearestPaletteIndex(palette[%d]) = %d", i, got)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	rl "github.com/gen2brain/raylib-go/raylib"
+	"sort"
+	"strings"
+)
+
+// maxScenes bounds how many scenes can be held at once
+const maxScenes = 8
+
+// Scene is a snapshot of every flip and layer buffer plus the drawing state
+type Scene struct {
+	flips  [][]rl.Color
+	layers [][]rl.Color
+	width  int32
+	height int32
+	ink    int
+	paper  int
+	bright bool
+	mode   string
+}
+
+// Saved scenes by name; only touched from the render loop
+var scenes = map[string]*Scene{}
+
+// saveScene snapshots the buffers and drawing state under name, replacing
+// any scene already saved with that name
+func saveScene(bs *BufferSystem, name string) error {
+	if _, exists := scenes[name]; !exists && len(scenes) >= maxScenes {
+		return fmt.Errorf("scene limit of %d reached", maxScenes)
+	}
+
+	// Make sure pending draws have reached the buffers before reading them
+	rl.DrawRenderBatchActive()
+
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	s := &Scene{
+		width:  bs.flipBuffers[0].Texture.Width,
+		height: bs.flipBuffers[0].Texture.Height,
+		ink:    defaultInk,
+		paper:  defaultPaper,
+		bright: defaultBright,
+		mode:   currentDrawingMode,
+	}
+	for _, rt := range bs.flipBuffers {
+		s.flips = append(s.flips, ReadBufferColors(rt))
+	}
+	for _, rt := range bs.layerBuffers {
+		s.layers = append(s.layers, ReadBufferColors(rt))
+	}
+	scenes[name] = s
+	return nil
+}
+
+// loadScene restores the buffers and drawing state saved under name
+func loadScene(bs *BufferSystem, name string) error {
+	s, ok := scenes[name]
+	if !ok {
+		return fmt.Errorf("no scene named %q", name)
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if s.width != bs.flipBuffers[0].Texture.Width || s.height != bs.flipBuffers[0].Texture.Height ||
+		len(s.flips) != len(bs.flipBuffers) || len(s.layers) != len(bs.layerBuffers) {
+		return fmt.Errorf("scene %q does not match the current buffers", name)
+	}
+
+	rl.DrawRenderBatchActive()
+	for i, rt := range bs.flipBuffers {
+		rl.UpdateTexture(rt.Texture, s.flips[i])
+	}
+	for i, rt := range bs.layerBuffers {
+		rl.UpdateTexture(rt.Texture, s.layers[i])
+	}
+
+	defaultInk = s.ink
+	defaultPaper = s.paper
+	defaultBright = s.bright
+	currentDrawingMode = s.mode
+	return nil
+}
+
+// deleteScene frees the scene saved under name
+func deleteScene(name string) error {
+	if _, ok := scenes[name]; !ok {
+		return fmt.Errorf("no scene named %q", name)
+	}
+	delete(scenes, name)
+	return nil
+}
+
+// sceneList returns the saved scene names in sorted order
+func sceneList() string {
+	names := make([]string, 0, len(scenes))
+	for name := range scenes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// saveScreenshot writes the visible flip and layer buffers as a PNG. With
+// transparent set, flip pixels in the paper colour become see-through so
+// the picture can be composited elsewhere.
+func saveScreenshot(bs *BufferSystem, name string, transparent bool) error {
+	path, err := safePath(name)
+	if err != nil {
+		return err
+	}
+
+	// Make sure pending draws have reached the buffers before reading them
+	rl.DrawRenderBatchActive()
+
+	flip, layer := bs.GetDisplayBuffers()
+	w, h := int(flip.Texture.Width), int(flip.Texture.Height)
+	flipPixels := ReadBufferColors(flip)
+	layerPixels := ReadBufferColors(layer)
+	key := palette[effectivePaperColor()]
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		// Render textures are stored upside down
+		row := (h - 1 - y) * w
+		for x := 0; x < w; x++ {
+			back := flipPixels[row+x]
+			if transparent && back.R == key.R && back.G == key.G && back.B == key.B {
+				back.A = 0
+			}
+			img.SetNRGBA(x, y, blendOver(layerPixels[row+x], back))
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// blendOver composites front over back with straight alpha
+func blendOver(front, back rl.Color) color.NRGBA {
+	fa, ba := int(front.A), int(back.A)
+	outA := fa + ba*(255-fa)/255
+	if outA == 0 {
+		return color.NRGBA{}
+	}
+	mix := func(f, b uint8) uint8 {
+		return uint8((int(f)*fa + int(b)*ba*(255-fa)/255) / outA)
+	}
+	return color.NRGBA{R: mix(front.R, back.R), G: mix(front.G, back.G), B: mix(front.B, back.B), A: uint8(outA)}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// scriptLine stands in for a client connection while a startup script line
+// runs, sending any error it produces to stderr with the line's position
+type scriptLine struct {
+	net.Conn
+	name string
+	line int
+}
+
+// Write reports error replies and drops the rest
+func (s *scriptLine) Write(b []byte) (int, error) {
+	if text := strings.TrimSpace(string(b)); strings.HasPrefix(text, "ERROR") {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", s.name, s.line, text)
+	}
+	return len(b), nil
+}
+
+// RemoteAddr is nil; there is no client
+func (s *scriptLine) RemoteAddr() net.Addr {
+	return nil
+}
+
+// runScript feeds the commands in a file through the same path as a
+// drawing connection, so the display can be set up before any client
+// connects. Blank lines and lines starting with # are skipped.
+func runScript(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening script:", err)
+		return
+	}
+	defer f.Close()
+
+	state := &connState{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmd, err := parseCommand(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: ERROR 0020 : %v\n", path, n, err)
+			continue
+		}
+
+		// A script can be longer than the command queue; wait for room
+		// rather than be told the server is busy
+		for len(commandChan) >= cap(commandChan) {
+			time.Sleep(time.Millisecond)
+		}
+
+		cmd.Conn = &scriptLine{name: path, line: n}
+		cmd.State = state
+		dispatchCommand(cmd, 0, nil)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading script:", err)
+	}
+
+	// Let the main loop free anything held for the script, such as an
+	// unfinished frame
+	commandChan <- DrawCommand{Cmd: "disconnect", State: state}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// Stencil mask, in render texture order, nil when off. A pixel is set where
+// the stencil buffer was neither transparent nor paper when it was chosen.
+// Only touched from the render loop.
+var (
+	stencil       []bool
+	stencilSource string // "flip n" or "layer n", for stencil?
+)
+
+// setStencil takes the mask from flip or layer buffer index
+func setStencil(bs *BufferSystem, kind string, index int) error {
+	rt, err := bs.Buffer(kind, index)
+	if err != nil {
+		return err
+	}
+	rl.DrawRenderBatchActive()
+	paper := palette[effectivePaperColor()]
+	pixels := ReadBufferColors(rt)
+	mask := make([]bool, len(pixels))
+	for i, c := range pixels {
+		mask[i] = c.A != 0 && c != paper
+	}
+	stencil = mask
+	stencilSource = fmt.Sprintf("%s %d", kind, index)
+	return nil
+}
+
+// clearStencil lets drawing reach every pixel again
+func clearStencil() {
+	stencil = nil
+	stencilSource = ""
+}
+
+// stencilSnapshot returns target's pixels before a draw, or nil if no
+// stencil applies to it
+func stencilSnapshot(target *rl.RenderTexture2D) []rl.Color {
+	if stencil == nil || len(stencil) != int(target.Texture.Width*target.Texture.Height) {
+		return nil
+	}
+	rl.DrawRenderBatchActive()
+	return ReadBufferColors(target)
+}
+
+// stencilRestore puts back the pixels outside the stencil that a draw
+// changed, given the snapshot taken before it
+func stencilRestore(target *rl.RenderTexture2D, before []rl.Color) {
+	if before == nil {
+		return
+	}
+	rl.DrawRenderBatchActive()
+	after := ReadBufferColors(target)
+	for i, set := range stencil {
+		if !set {
+			after[i] = before[i]
+		}
+	}
+	rl.UpdateTexture(target.Texture, after)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// timerList describes the periodic work the render loop is doing, one
+// entry per buffer watch, colour cycle, mouse tracking and vblank events,
+// separated by "; ". Each can be stopped with its own command.
+func timerList() string {
+	now := time.Now()
+	remaining := func(next time.Time) int64 {
+		return max(0, next.Sub(now).Milliseconds())
+	}
+
+	var list []string
+	for _, w := range bufferWatches {
+		list = append(list, fmt.Sprintf("watchbuffer %s %d every=%dms due=%dms",
+			w.kind, w.index, w.interval.Milliseconds(), remaining(w.next)))
+	}
+	for _, c := range colourCycles {
+		list = append(list, fmt.Sprintf("cyclecolours %d %d every=%dms due=%dms",
+			c.start, c.end, c.interval.Milliseconds(), remaining(c.next)))
+	}
+	sort.Strings(list)
+	if trackMouseMs > 0 {
+		list = append(list, fmt.Sprintf("trackmouse every=%dms", trackMouseMs))
+	}
+	if vblankEvery > 0 {
+		list = append(list, fmt.Sprintf("vblank frames=%d", vblankEvery))
+	}
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, "; ")
+}